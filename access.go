@@ -0,0 +1,71 @@
+package billycgofuse
+
+import "github.com/billziss-gh/cgofuse/fuse"
+
+// The bits of the mask passed to Access, from unistd.h.
+const (
+	rOK = 4
+	wOK = 2
+	xOK = 1
+)
+
+// Access checks file access permissions.
+// The caller is matched against the owner and group set with WithOwner to pick the permission bits that apply.
+// The mode comes from Getattr, so it's cached along with the other attributes by WithAttrCache, and a Chmod
+// through the mount takes effect immediately.
+func (w *wrapper) Access(path string, mask uint32) int {
+	var st fuse.Stat_t
+	if errc := w.Getattr(path, &st, ^uint64(0)); errc != 0 {
+		return errc
+	}
+	uid, gid, _ := fuse.Getcontext()
+	return w.checkAccess(st.Mode, uid, gid, mask)
+}
+
+// checkAccess evaluates mask against mode, in FUSE bits, for a caller with the given uid and gid, like the kernel
+// would.
+func (w *wrapper) checkAccess(mode uint32, uid, gid uint32, mask uint32) int {
+	mask &= rOK | wOK | xOK
+	if mask == 0 {
+		// F_OK: the file exists.
+		return 0
+	}
+	perm := mode & 0777
+	if uid == 0 {
+		// Root can read and write anything and search any directory, but only execute files that have an execute bit set.
+		if mask&xOK != 0 && mode&fuse.S_IFMT != fuse.S_IFDIR && perm&0111 == 0 {
+			return -fuse.EACCES
+		}
+		return 0
+	}
+	var bits uint32
+	switch {
+	case uid == w.uid:
+		bits = perm >> 6
+	case w.inGroup(gid, w.gid):
+		bits = perm >> 3
+	default:
+		bits = perm
+	}
+	if bits&mask != mask {
+		return -fuse.EACCES
+	}
+	return 0
+}
+
+// inGroup returns whether the caller, whose primary group is gid, is a member of group.
+// Supplementary groups are only considered with WithCallerGroups.
+func (w *wrapper) inGroup(gid, group uint32) bool {
+	if gid == group {
+		return true
+	}
+	if w.callerGroups == nil {
+		return false
+	}
+	for _, g := range w.callerGroups() {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,157 @@
+package billycgofuse
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/billziss-gh/cgofuse/fuse"
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+)
+
+// accessAs does what Access does for a caller with the given uid and gid. Access itself gets those from
+// fuse.Getcontext, which only works while serving a FUSE request.
+func accessAs(t *testing.T, w *wrapper, path string, uid, gid, mask uint32) int {
+	t.Helper()
+	var st fuse.Stat_t
+	if errc := w.Getattr(path, &st, ^uint64(0)); errc != 0 {
+		t.Fatalf("Getattr(%q) = %d", path, errc)
+	}
+	return w.checkAccess(st.Mode, uid, gid, mask)
+}
+
+func TestAccessExecute(t *testing.T) {
+	const owner, group = 1000, 100
+	bfs := memfs.New()
+	w := newWrapper(bfs, []Option{WithOwner(owner, group)})
+	for _, tc := range []struct {
+		name string
+		dir  bool
+		mode uint32
+		uid  uint32
+		gid  uint32
+		want int
+	}{
+		{"owner searches directory", true, 0700, owner, 200, 0},
+		{"owner can't search directory without x", true, 0600, owner, group, -fuse.EACCES},
+		{"group searches directory", true, 0750, 2000, group, 0},
+		{"group can't search directory without x", true, 0701, 2000, group, -fuse.EACCES},
+		{"other searches directory", true, 0701, 2000, 200, 0},
+		{"other can't search directory without x", true, 0770, 2000, 200, -fuse.EACCES},
+		{"root searches directory without x", true, 0600, 0, 0, 0},
+		{"owner executes file", false, 0744, owner, 200, 0},
+		{"group executes file", false, 0654, 2000, group, 0},
+		{"group can't execute file without x", false, 0745, 2000, group, -fuse.EACCES},
+		{"other executes file", false, 0645, 2000, 200, 0},
+		{"other can't execute file without x", false, 0754, 2000, 200, -fuse.EACCES},
+		{"root executes file with any x", false, 0601, 0, 0, 0},
+		{"root can't execute file without x", false, 0666, 0, 0, -fuse.EACCES},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.dir {
+				if errc := w.Mkdir("/x", tc.mode); errc != 0 {
+					t.Fatalf("Mkdir() = %d", errc)
+				}
+				defer w.Rmdir("/x")
+			} else {
+				errc, fd := w.Create("/x", fuse.O_WRONLY, tc.mode)
+				if errc != 0 {
+					t.Fatalf("Create() = %d", errc)
+				}
+				w.Release("/x", fd)
+				defer w.Unlink("/x")
+			}
+			if got := accessAs(t, w, "/x", tc.uid, tc.gid, xOK); got != tc.want {
+				t.Errorf("Access(X_OK) = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+// chmodFS adds Chmod to a filesystem that doesn't have it, by keeping the modes that were set on the side.
+type chmodFS struct {
+	billy.Filesystem
+	mtx   sync.Mutex
+	modes map[string]os.FileMode
+}
+
+func (fs *chmodFS) Stat(filename string) (os.FileInfo, error) {
+	fi, err := fs.Filesystem.Stat(filename)
+	return fs.withMode(filename, fi, err)
+}
+
+func (fs *chmodFS) Lstat(filename string) (os.FileInfo, error) {
+	fi, err := fs.Filesystem.Lstat(filename)
+	return fs.withMode(filename, fi, err)
+}
+
+func (fs *chmodFS) withMode(filename string, fi os.FileInfo, err error) (os.FileInfo, error) {
+	if err != nil {
+		return nil, err
+	}
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	if m, ok := fs.modes[filename]; ok {
+		return modeFileInfo{fi, fi.Mode()&os.ModeType | m}, nil
+	}
+	return fi, nil
+}
+
+func (fs *chmodFS) Chmod(name string, mode os.FileMode) error {
+	if _, err := fs.Filesystem.Stat(name); err != nil {
+		return err
+	}
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	if fs.modes == nil {
+		fs.modes = map[string]os.FileMode{}
+	}
+	fs.modes[name] = mode.Perm()
+	return nil
+}
+
+func (fs *chmodFS) Lchown(name string, uid, gid int) error {
+	return billy.ErrNotSupported
+}
+
+func (fs *chmodFS) Chown(name string, uid, gid int) error {
+	return billy.ErrNotSupported
+}
+
+func (fs *chmodFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return billy.ErrNotSupported
+}
+
+type modeFileInfo struct {
+	os.FileInfo
+	mode os.FileMode
+}
+
+func (fi modeFileInfo) Mode() os.FileMode {
+	return fi.mode
+}
+
+func TestChmodChangesAccess(t *testing.T) {
+	const owner, group = 1000, 100
+	bfs := &chmodFS{Filesystem: memfs.New()}
+	writeFile(t, bfs, "/file", "hello")
+	// Attributes are cached for long enough that only invalidation by Chmod makes the change visible.
+	w := newWrapper(bfs, []Option{WithOwner(owner, group), WithAttrCache(time.Hour)})
+	for _, tc := range []struct {
+		mode uint32
+		want int
+	}{
+		{0600, 0},
+		{0400, -fuse.EACCES},
+		{0200, 0},
+	} {
+		if errc := w.Chmod("/file", tc.mode); errc != 0 {
+			t.Fatalf("Chmod(%#o) = %d", tc.mode, errc)
+		}
+		if got := accessAs(t, w, "/file", owner, group, wOK); got != tc.want {
+			t.Errorf("Access(W_OK) after Chmod(%#o) = %d, want %d", tc.mode, got, tc.want)
+		}
+	}
+}
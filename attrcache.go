@@ -0,0 +1,118 @@
+package billycgofuse
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/billziss-gh/cgofuse/fuse"
+)
+
+// attrCache caches the results of Getattr for a short while.
+//
+// Entries are tied to the write generation of a path (see pathGeneration), so writes through any open file
+// invalidate them right away, even if they race with the Getattr that filled the entry.
+type attrCache struct {
+	ttl time.Duration
+
+	mtx     sync.Mutex
+	entries map[string]attrCacheEntry
+}
+
+type attrCacheEntry struct {
+	stat    fuse.Stat_t
+	gen     uint64
+	expires time.Time
+}
+
+func newAttrCache(ttl time.Duration) *attrCache {
+	return &attrCache{
+		ttl:     ttl,
+		entries: map[string]attrCacheEntry{},
+	}
+}
+
+func (c *attrCache) get(path string, gen uint64, now time.Time) (fuse.Stat_t, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	e, ok := c.entries[path]
+	if !ok {
+		return fuse.Stat_t{}, false
+	}
+	if e.gen != gen || now.After(e.expires) {
+		delete(c.entries, path)
+		return fuse.Stat_t{}, false
+	}
+	return e.stat, true
+}
+
+func (c *attrCache) put(path string, stat fuse.Stat_t, gen uint64, now time.Time) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.entries[path] = attrCacheEntry{
+		stat:    stat,
+		gen:     gen,
+		expires: now.Add(c.ttl),
+	}
+}
+
+func (c *attrCache) invalidate(paths ...string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, p := range paths {
+		delete(c.entries, p)
+	}
+}
+
+// invalidateTree drops the entries for path and everything below it.
+func (c *attrCache) invalidateTree(path string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	for p := range c.entries {
+		if p == path || strings.HasPrefix(p, prefix) {
+			delete(c.entries, p)
+		}
+	}
+}
+
+// invalidateAttrs drops cached attributes for the given paths, after they've been modified.
+func (w *wrapper) invalidateAttrs(paths ...string) {
+	if w.attrCache != nil {
+		w.attrCache.invalidate(paths...)
+	}
+}
+
+// primeAttrs puts the attributes of path in the cache, so a Getattr that follows doesn't need to ask the backend.
+func (w *wrapper) primeAttrs(path string) {
+	if w.attrCache == nil {
+		return
+	}
+	gen := w.pathGeneration(path)
+	var st fuse.Stat_t
+	if w.getattr(path, &st) == 0 {
+		w.attrCache.put(path, st, gen, w.now())
+	}
+}
+
+// bumpGeneration records that of was modified. Cached attributes of its path become invalid.
+func (w *wrapper) bumpGeneration(of *openFile) {
+	atomic.StoreUint64(&of.generation, atomic.AddUint64(&w.generation, 1))
+}
+
+// pathGeneration returns the generation of the last modification through an open file for path.
+// Releasing a file also invalidates the cache for its path, so the generation going down again is harmless.
+func (w *wrapper) pathGeneration(path string) uint64 {
+	w.fdMtx.Lock()
+	defer w.fdMtx.Unlock()
+	var gen uint64
+	for _, of := range w.fileDescriptors {
+		if of.path == path {
+			if g := atomic.LoadUint64(&of.generation); g > gen {
+				gen = g
+			}
+		}
+	}
+	return gen
+}
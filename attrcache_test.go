@@ -0,0 +1,37 @@
+package billycgofuse
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/billziss-gh/cgofuse/fuse"
+)
+
+func TestAttrCacheSeesWrites(t *testing.T) {
+	fs, _ := newTestFS(t, WithAttrCache(time.Hour))
+	errc, fd := fs.Create("/file", os.O_WRONLY, 0644)
+	if errc != 0 {
+		t.Fatalf("Create() = %d", errc)
+	}
+	defer fs.Release("/file", fd)
+	wantSize := func(want int64) {
+		t.Helper()
+		var st fuse.Stat_t
+		if errc := fs.Getattr("/file", &st, ^uint64(0)); errc != 0 {
+			t.Fatalf("Getattr() = %d", errc)
+		}
+		if st.Size != want {
+			t.Errorf("Getattr() reported size %d, want %d", st.Size, want)
+		}
+	}
+	wantSize(0)
+	if n := fs.Write("/file", []byte("hello"), 0, fd); n != 5 {
+		t.Fatalf("Write() = %d, want 5", n)
+	}
+	wantSize(5)
+	if errc := fs.Truncate("/file", 2, fd); errc != 0 {
+		t.Fatalf("Truncate() = %d", errc)
+	}
+	wantSize(2)
+}
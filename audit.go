@@ -0,0 +1,69 @@
+package billycgofuse
+
+import (
+	"sync"
+	"time"
+
+	"github.com/billziss-gh/cgofuse/fuse"
+)
+
+// AuditEntry describes an operation for WithAuditLog.
+type AuditEntry struct {
+	Time time.Time
+	// Op is the name of the FUSE operation, like "Write" or "Rename".
+	Op   string
+	Path string
+	// NewPath is the destination of a Rename, or the target of a Symlink.
+	NewPath string
+	// Bytes is the number of bytes transferred by a Read or Write, or the new size for Truncate.
+	Bytes int64
+	// Uid, Gid and Pid identify the caller.
+	Uid uint32
+	Gid uint32
+	Pid int
+	// Errno is the error returned to the kernel as a negative number, or 0 on success.
+	Errno int
+}
+
+// auditBufferSize is the number of entries that can be waiting for the WithAuditLog callback.
+const auditBufferSize = 1024
+
+// auditor passes AuditEntries to the WithAuditLog callback on its own goroutine.
+type auditor struct {
+	f     func(AuditEntry)
+	ch    chan AuditEntry
+	start sync.Once
+	done  chan struct{}
+}
+
+func (a *auditor) run() {
+	defer close(a.done)
+	for e := range a.ch {
+		a.f(e)
+	}
+}
+
+// audit queues an entry for the WithAuditLog callback. If the callback can't keep up, the entry is dropped and
+// logged, because we don't want to block the operation.
+func (w *wrapper) audit(op, path, newPath string, bytes int64, errc int) {
+	uid, gid, pid := fuse.Getcontext()
+	e := AuditEntry{
+		Time:    w.now(),
+		Op:      op,
+		Path:    path,
+		NewPath: newPath,
+		Bytes:   bytes,
+		Uid:     uid,
+		Gid:     gid,
+		Pid:     pid,
+		Errno:   errc,
+	}
+	w.auditor.start.Do(func() {
+		go w.auditor.run()
+	})
+	select {
+	case w.auditor.ch <- e:
+	default:
+		w.logf("audit log is falling behind, dropped %s %q", op, path)
+	}
+}
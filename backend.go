@@ -0,0 +1,45 @@
+package billycgofuse
+
+import "github.com/go-git/go-billy/v5"
+
+// backendHolder wraps the billy filesystem, because atomic.Value needs the same concrete type for every Store.
+type backendHolder struct {
+	fs billy.Basic
+	// replicas are the WithReadReplicas replicas, wrapped in the same layers as fs.
+	replicas []billy.Basic
+}
+
+// backend returns the billy filesystem operations should go to.
+func (w *wrapper) backend() billy.Basic {
+	return w.underlying.Load().(backendHolder).fs
+}
+
+// setBackend makes operations go to fs, wrapped in the WithStripPrefix and WithOverlay layers if those were given.
+// The read replicas get the same layers, so they serve the same view as fs.
+func (w *wrapper) setBackend(fs billy.Basic) {
+	h := backendHolder{fs: w.layer(fs)}
+	for _, r := range w.readReplicas {
+		h.replicas = append(h.replicas, w.layer(r))
+	}
+	w.underlying.Store(h)
+}
+
+// layer wraps fs in the WithStripPrefix and WithOverlay layers if those were given.
+func (w *wrapper) layer(fs billy.Basic) billy.Basic {
+	if w.stripPrefix != "" {
+		fs = &prefixFS{fs: fs, prefix: w.stripPrefix}
+	}
+	if w.overlayLower != nil {
+		fs = &overlayFS{upper: fs, lower: w.overlayLower, whiteouts: w.overlayWhiteouts}
+	}
+	return fs
+}
+
+// SwapUnderlying replaces the filesystem passed to New.
+func (w *wrapper) SwapUnderlying(fs billy.Basic) {
+	w.setBackend(fs)
+	if w.attrCache != nil {
+		w.attrCache.invalidateTree("/")
+	}
+	w.invalidateReadCache("/")
+}
@@ -0,0 +1,35 @@
+package billycgofuse
+
+import "sync"
+
+// memoryBudget limits the memory held by buffers of all file descriptors together, for WithMemoryBudget.
+// A nil *memoryBudget has no limit.
+type memoryBudget struct {
+	mtx   sync.Mutex
+	limit int64
+	used  int64
+}
+
+// reserve claims n bytes. It returns false if that would exceed the budget, in which case nothing was claimed.
+func (b *memoryBudget) reserve(n int64) bool {
+	if b == nil {
+		return true
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.used+n > b.limit {
+		return false
+	}
+	b.used += n
+	return true
+}
+
+// free returns n bytes claimed by reserve.
+func (b *memoryBudget) free(n int64) {
+	if b == nil {
+		return
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.used -= n
+}
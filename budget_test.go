@@ -0,0 +1,68 @@
+package billycgofuse
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// waitForBudget waits until b has want bytes in use, which can take a moment if a prefetch is still in flight.
+func waitForBudget(t *testing.T, b *memoryBudget, want int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b.mtx.Lock()
+		used := b.used
+		b.mtx.Unlock()
+		if used == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("memory budget has %d bytes in use, want %d", used, want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMemoryBudgetEviction(t *testing.T) {
+	bfs, data := newSlowFS(t, 0, 16<<10)
+	writeFile(t, bfs, "/other", string(data))
+	w := newWrapper(bfs, []Option{WithReadAhead(4096), WithMemoryBudget(4096)})
+	buff := make([]byte, 4096)
+	read := func(path string, fd uint64, ofst int64) {
+		t.Helper()
+		if n := w.Read(path, buff, ofst, fd); n != len(buff) {
+			t.Fatalf("Read(%q, %d) = %d, want %d", path, ofst, n, len(buff))
+		}
+	}
+	fd1 := open(t, w, "/file", os.O_RDWR)
+	fd2 := open(t, w, "/other", os.O_RDONLY)
+
+	// The prefetch of the first file takes up the whole budget.
+	read("/file", fd1, 0)
+	waitForBudget(t, w.memoryBudget, 4096)
+	read("/other", fd2, 0)
+	of, _ := w.getFileDescriptor(fd2)
+	of.readAhead.mtx.Lock()
+	if of.readAhead.pending != nil || of.readAhead.held != 0 {
+		t.Errorf("second file prefetched although the budget was used up")
+	}
+	of.readAhead.mtx.Unlock()
+
+	// Modifying the first file drops its buffer, which makes room for the second file.
+	if n := w.Write("/file", []byte("x"), 0, fd1); n != 1 {
+		t.Fatalf("Write() = %d, want 1", n)
+	}
+	waitForBudget(t, w.memoryBudget, 0)
+	read("/other", fd2, 4096)
+	waitForBudget(t, w.memoryBudget, 4096)
+
+	// Closing a file returns its buffer too.
+	if errc := w.Release("/other", fd2); errc != 0 {
+		t.Fatalf("Release() = %d", errc)
+	}
+	waitForBudget(t, w.memoryBudget, 0)
+	if errc := w.Release("/file", fd1); errc != 0 {
+		t.Fatalf("Release() = %d", errc)
+	}
+}
@@ -0,0 +1,71 @@
+package billycgofuse
+
+import (
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// caseResolver remembers the real names of paths that were looked up case-insensitively.
+type caseResolver struct {
+	mtx   sync.Mutex
+	names map[string]string
+}
+
+func newCaseResolver() *caseResolver {
+	return &caseResolver{
+		names: map[string]string{},
+	}
+}
+
+// resolveCase finds the path on the backend that matches p case-insensitively.
+// It's only used after an exact lookup failed, so the common case stays cheap.
+func (w *wrapper) resolveCase(p string) (string, bool) {
+	if w.caseResolver == nil {
+		return "", false
+	}
+	dfs, ok := w.backend().(billy.Dir)
+	if !ok {
+		return "", false
+	}
+	key := strings.ToLower(p)
+	cr := w.caseResolver
+	cr.mtx.Lock()
+	real, ok := cr.names[key]
+	cr.mtx.Unlock()
+	if ok {
+		if _, err := w.backend().Stat(real); err == nil {
+			return real, true
+		}
+		cr.mtx.Lock()
+		delete(cr.names, key)
+		cr.mtx.Unlock()
+	}
+	dir, name := path.Split(p)
+	dir = path.Clean(dir)
+	if dir != "/" && dir != "." {
+		if _, err := w.backend().Stat(dir); err != nil {
+			var ok bool
+			dir, ok = w.resolveCase(dir)
+			if !ok {
+				return "", false
+			}
+		}
+	}
+	entries, err := dfs.ReadDir(dir)
+	if err != nil {
+		return "", false
+	}
+	for _, e := range entries {
+		if strings.EqualFold(e.Name(), name) {
+			real = path.Join(dir, e.Name())
+			cr.mtx.Lock()
+			cr.names[key] = real
+			cr.mtx.Unlock()
+			return real, true
+		}
+	}
+	return "", false
+}
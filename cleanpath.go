@@ -0,0 +1,30 @@
+package billycgofuse
+
+import (
+	gopath "path"
+	"strings"
+
+	"github.com/billziss-gh/cgofuse/fuse"
+)
+
+// cleanPath collapses "." and ".." elements in a path we got from the kernel, so backends don't have to deal with them.
+// Paths that would go above the root get EACCES, rather than silently being clamped to the root.
+func cleanPath(path string) (string, int) {
+	if !strings.Contains(path, "/.") && !strings.Contains(path, "//") {
+		return path, 0
+	}
+	depth := 0
+	for _, e := range strings.Split(path, "/") {
+		switch e {
+		case "", ".":
+		case "..":
+			depth--
+			if depth < 0 {
+				return "", -fuse.EACCES
+			}
+		default:
+			depth++
+		}
+	}
+	return gopath.Clean("/" + path), 0
+}
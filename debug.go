@@ -0,0 +1,133 @@
+package billycgofuse
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/billziss-gh/cgofuse/fuse"
+	"github.com/go-git/go-billy/v5"
+)
+
+// logf logs a message tagged with the name of this filesystem.
+func (w *wrapper) logf(format string, args ...interface{}) {
+	prefix := "billycgofuse"
+	if w.name != "" {
+		prefix += "[" + w.name + "]"
+	}
+	w.logger.Printf(prefix+": "+format, args...)
+}
+
+// logErrno logs the result of an operation that we can't return to the kernel.
+func (w *wrapper) logErrno(op, path string, errc int) {
+	w.logf("%s %q: %s (%d)", op, path, errnoName(errc), errc)
+}
+
+// closeAndLog closes fh for an operation that has already decided what to return, and logs if that fails.
+func (w *wrapper) closeAndLog(op, path string, fh billy.File) {
+	if errc := convertError(fh.Close()); errc != 0 {
+		w.logErrno(op, path, errc)
+	}
+}
+
+// violation reports a broken invariant. It's always logged and panics if the user asked for that.
+func (w *wrapper) violation(format string, args ...interface{}) {
+	msg := fmt.Sprintf("invariant violated: "+format, args...)
+	w.logf("%s", msg)
+	if w.panicOnViolation {
+		panic(msg)
+	}
+}
+
+// checkTableLocked verifies that every file descriptor has a write lock and vice versa.
+// w.fdMtx must be held.
+func (w *wrapper) checkTableLocked() {
+	if !w.debugChecks {
+		return
+	}
+	if len(w.fileDescriptors) != len(w.writeLocks) {
+		w.violation("%d file descriptors but %d write locks", len(w.fileDescriptors), len(w.writeLocks))
+	}
+}
+
+func (w *wrapper) checkOffset(op string, ofst int64) {
+	if w.debugChecks && ofst < 0 {
+		w.violation("%s called with negative offset %d", op, ofst)
+	}
+}
+
+var errnoNames = []struct {
+	errno int
+	name  string
+}{
+	{fuse.EPERM, "EPERM"},
+	{fuse.ENOENT, "ENOENT"},
+	{fuse.EINTR, "EINTR"},
+	{fuse.EIO, "EIO"},
+	{fuse.EBADF, "EBADF"},
+	{fuse.EAGAIN, "EAGAIN"},
+	{fuse.EACCES, "EACCES"},
+	{fuse.EBUSY, "EBUSY"},
+	{fuse.EEXIST, "EEXIST"},
+	{fuse.EXDEV, "EXDEV"},
+	{fuse.ENOTDIR, "ENOTDIR"},
+	{fuse.EISDIR, "EISDIR"},
+	{fuse.EINVAL, "EINVAL"},
+	{fuse.EMFILE, "EMFILE"},
+	{fuse.ENOTTY, "ENOTTY"},
+	{fuse.EFBIG, "EFBIG"},
+	{fuse.ENOSPC, "ENOSPC"},
+	{fuse.EROFS, "EROFS"},
+	{fuse.ERANGE, "ERANGE"},
+	{fuse.ENAMETOOLONG, "ENAMETOOLONG"},
+	{fuse.ENOSYS, "ENOSYS"},
+	{fuse.ENOTEMPTY, "ENOTEMPTY"},
+	{fuse.ELOOP, "ELOOP"},
+	{fuse.ENOATTR, "ENOATTR"},
+	{fuse.ENOTSUP, "ENOTSUP"},
+	{fuse.ETIMEDOUT, "ETIMEDOUT"},
+}
+
+// errnoName returns the symbolic name of a (possibly negated) errno, like "ENOENT".
+func errnoName(errc int) string {
+	if errc < 0 {
+		errc = -errc
+	}
+	if errc == 0 {
+		return "OK"
+	}
+	for _, e := range errnoNames {
+		if e.errno == errc {
+			return e.name
+		}
+	}
+	return fmt.Sprintf("errno %d", errc)
+}
+
+// HandleInfo describes an open file, as returned by OpenHandles.
+type HandleInfo struct {
+	Fd   uint64
+	Path string
+	// Flags are the flags the file was opened with, a combination of the fuse.O_* constants.
+	Flags    int
+	OpenedAt time.Time
+}
+
+// OpenHandles returns the files that are currently open, ordered by file descriptor.
+func (w *wrapper) OpenHandles() []HandleInfo {
+	w.fdMtx.Lock()
+	ret := make([]HandleInfo, 0, len(w.fileDescriptors))
+	for fd, of := range w.fileDescriptors {
+		ret = append(ret, HandleInfo{
+			Fd:       fd,
+			Path:     of.path,
+			Flags:    of.flags,
+			OpenedAt: of.openedAt,
+		})
+	}
+	w.fdMtx.Unlock()
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Fd < ret[j].Fd
+	})
+	return ret
+}
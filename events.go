@@ -0,0 +1,58 @@
+package billycgofuse
+
+// EventOp is the kind of change an Event describes.
+type EventOp int
+
+const (
+	// EventCreate is sent for new files, directories, symlinks and other nodes.
+	EventCreate EventOp = iota
+	// EventWrite is sent for writes and truncations.
+	EventWrite
+	// EventRemove is sent for removed files and directories.
+	EventRemove
+	// EventRename is sent for renames. Event.NewPath holds the new name.
+	EventRename
+	// EventChmod is sent for changes in permissions, ownership and times.
+	EventChmod
+)
+
+// String returns the name of the operation, like "CREATE".
+func (op EventOp) String() string {
+	switch op {
+	case EventCreate:
+		return "CREATE"
+	case EventWrite:
+		return "WRITE"
+	case EventRemove:
+		return "REMOVE"
+	case EventRename:
+		return "RENAME"
+	case EventChmod:
+		return "CHMOD"
+	}
+	return "UNKNOWN"
+}
+
+// Event describes a change made through the mount, for WithEventEmitter.
+type Event struct {
+	Op   EventOp
+	Path string
+	// NewPath is the destination of a rename.
+	NewPath string
+}
+
+// eventOps maps the operations passed to record to the events they cause.
+var eventOps = map[string]EventOp{
+	"Mknod":    EventCreate,
+	"Mkdir":    EventCreate,
+	"Symlink":  EventCreate,
+	"Create":   EventCreate,
+	"Write":    EventWrite,
+	"Truncate": EventWrite,
+	"Unlink":   EventRemove,
+	"Rmdir":    EventRemove,
+	"Rename":   EventRename,
+	"Chmod":    EventChmod,
+	"Chown":    EventChmod,
+	"Utimens":  EventChmod,
+}
@@ -0,0 +1,55 @@
+package billycgofuse
+
+import (
+	"os"
+	gopath "path"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// flatToBackend converts a path as seen through FUSE to the path on the backend.
+// Without WithFlatLayout this is a no-op. With separator "%", "/a%b%c" becomes "/a/b/c".
+func (w *wrapper) flatToBackend(path string) string {
+	if w.flatSep == "" {
+		return path
+	}
+	return "/" + strings.ReplaceAll(strings.TrimPrefix(path, "/"), w.flatSep, "/")
+}
+
+// readFlatDir lists every file on the backend as if it lived in the root,
+// with the slashes in its path replaced by the separator.
+func (w *wrapper) readFlatDir(dfs billy.Dir) ([]os.FileInfo, error) {
+	var ret []os.FileInfo
+	var walk func(dir, prefix string) error
+	walk = func(dir, prefix string) error {
+		entries, err := dfs.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if e.IsDir() {
+				if err := walk(gopath.Join(dir, e.Name()), prefix+e.Name()+w.flatSep); err != nil {
+					return err
+				}
+				continue
+			}
+			ret = append(ret, renamedFileInfo{e, prefix + e.Name()})
+		}
+		return nil
+	}
+	if err := walk("/", ""); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// renamedFileInfo is an os.FileInfo with a different name.
+type renamedFileInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (fi renamedFileInfo) Name() string {
+	return fi.name
+}
@@ -0,0 +1,72 @@
+package billycgofuse
+
+import (
+	"sync"
+	"time"
+)
+
+// fsyncBatcher coalesces Sync calls on a file that arrive within a short window into one.
+type fsyncBatcher struct {
+	file   syncer
+	window time.Duration
+
+	mtx   sync.Mutex
+	batch *fsyncBatch
+}
+
+// fsyncBatch is a set of callers waiting for the same Sync call.
+type fsyncBatch struct {
+	timer *time.Timer
+	done  chan struct{}
+	err   error
+}
+
+func newFsyncBatcher(file syncer, window time.Duration) *fsyncBatcher {
+	return &fsyncBatcher{
+		file:   file,
+		window: window,
+	}
+}
+
+// sync joins the pending batch (or starts a new one) and returns the result of its Sync.
+func (b *fsyncBatcher) sync() error {
+	b.mtx.Lock()
+	batch := b.batch
+	if batch == nil {
+		batch = &fsyncBatch{
+			done: make(chan struct{}),
+		}
+		batch.timer = time.AfterFunc(b.window, func() {
+			b.run(batch)
+		})
+		b.batch = batch
+	}
+	b.mtx.Unlock()
+	<-batch.done
+	return batch.err
+}
+
+// run syncs the file on behalf of everyone in batch, unless that already happened.
+// Callers that arrive while the Sync is in progress start a new batch, because their writes might not be covered by it.
+func (b *fsyncBatcher) run(batch *fsyncBatch) {
+	b.mtx.Lock()
+	if b.batch != batch {
+		b.mtx.Unlock()
+		return
+	}
+	b.batch = nil
+	b.mtx.Unlock()
+	batch.err = b.file.Sync()
+	close(batch.done)
+}
+
+// flush runs the pending batch right away, if there is one.
+func (b *fsyncBatcher) flush() {
+	b.mtx.Lock()
+	batch := b.batch
+	b.mtx.Unlock()
+	if batch != nil {
+		batch.timer.Stop()
+		b.run(batch)
+	}
+}
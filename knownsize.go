@@ -0,0 +1,52 @@
+package billycgofuse
+
+import (
+	"sync/atomic"
+
+	"github.com/billziss-gh/cgofuse/fuse"
+)
+
+// noteSize records that Write made the file of of at least size bytes, for WithWriteThroughAttrUpdate.
+func (w *wrapper) noteSize(of *openFile, size int64) {
+	if !w.writeThroughAttrs {
+		return
+	}
+	for {
+		old := atomic.LoadInt64(&of.knownSize)
+		if size <= old || atomic.CompareAndSwapInt64(&of.knownSize, old, size) {
+			return
+		}
+	}
+}
+
+// setKnownSize records that Truncate set the size of path, for WithWriteThroughAttrUpdate.
+func (w *wrapper) setKnownSize(path string, size int64) {
+	if !w.writeThroughAttrs {
+		return
+	}
+	w.fdMtx.Lock()
+	defer w.fdMtx.Unlock()
+	for _, of := range w.fileDescriptors {
+		if of.path == path {
+			atomic.StoreInt64(&of.knownSize, size)
+		}
+	}
+}
+
+// applyKnownSize raises the size in stat to the size that writes through the open files of path are known to
+// have given it, in case the backend hasn't caught up yet.
+func (w *wrapper) applyKnownSize(path string, stat *fuse.Stat_t) {
+	if !w.writeThroughAttrs || stat.Mode&fuse.S_IFMT != fuse.S_IFREG {
+		return
+	}
+	w.fdMtx.Lock()
+	defer w.fdMtx.Unlock()
+	for _, of := range w.fileDescriptors {
+		if of.path != path {
+			continue
+		}
+		if size := atomic.LoadInt64(&of.knownSize); size > stat.Size {
+			stat.Size = size
+		}
+	}
+}
@@ -2,68 +2,342 @@
 package billycgofuse
 
 import (
+	"context"
 	"errors"
 	"io"
+	"log"
 	"os"
+	gopath "path"
+	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/billziss-gh/cgofuse/fuse"
 	"github.com/go-git/go-billy/v5"
 )
 
-func New(underlying billy.Basic) fuse.FileSystemInterface {
-	return &wrapper{
-		underlying:      underlying,
-		fileDescriptors: map[uint64]billy.File{},
+// FileSystem is the fuse.FileSystemInterface returned by New.
+// It has a few extra methods for whoever manages the mount.
+type FileSystem interface {
+	fuse.FileSystemInterface
+
+	// Ping checks whether the underlying filesystem is reachable by doing a Stat of the root.
+	// It doesn't go through FUSE and is suitable for readiness probes.
+	Ping() error
+
+	// InvalidatePath drops everything cached about path, like attributes and prefetched data.
+	// Call it when the backend was modified without going through the mount.
+	InvalidatePath(path string)
+
+	// SwapUnderlying replaces the filesystem passed to New. New operations use fs, while files that are already
+	// open keep using the filesystem they were opened on until they're closed.
+	SwapUnderlying(fs billy.Basic)
+
+	// OpenHandles returns the files that are currently open, ordered by file descriptor.
+	// It's meant for debugging leaked file handles.
+	OpenHandles() []HandleInfo
+}
+
+// New returns a FileSystem that passes calls to underlying.
+func New(underlying billy.Basic, opts ...Option) FileSystem {
+	w := newWrapper(underlying, opts)
+	if w.auditor != nil || w.emitter != nil {
+		return observedWrapper{w}
+	}
+	return w
+}
+
+func newWrapper(underlying billy.Basic, opts []Option) *wrapper {
+	w := &wrapper{
+		fileDescriptors: map[uint64]*openFile{},
 		writeLocks:      map[uint64]*sync.Mutex{},
+		logger:          log.Default(),
+		followSymlinks:  true,
+		defaultStatFS:   defaultStatFS,
+		now:             time.Now,
+	}
+	for _, o := range opts {
+		o(w)
 	}
+	w.setBackend(underlying)
+	return w
 }
 
 type wrapper struct {
 	fuse.FileSystemBase
-	underlying billy.Basic
+	// underlying holds a backendHolder with the billy filesystem. Use backend() to get it.
+	underlying atomic.Value
 
 	fdMtx           sync.Mutex
-	fileDescriptors map[uint64]billy.File
+	fileDescriptors map[uint64]*openFile
 	nextFd          uint64
 	writeLocks      map[uint64]*sync.Mutex
+
+	name              string
+	logger            *log.Logger
+	debugChecks       bool
+	panicOnViolation  bool
+	syncOnClose       bool
+	pathLocks         *pathLocker
+	readAheadSize     int
+	discardWrites     bool
+	caseResolver      *caseResolver
+	followSymlinks    bool
+	defaultStatFS     StatFS
+	maxReadSize       int
+	maxWriteSize      int
+	fsyncWindow       time.Duration
+	openTimeout       time.Duration
+	attrCache         *attrCache
+	uid               uint32
+	gid               uint32
+	now               func() time.Time
+	flatSep           string
+	readdirBatchSize  int
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	ready             func()
+	asyncRelease      bool
+	readdirFilter     func(name string, fi os.FileInfo) bool
+	virtualFiles      map[string]func() ([]byte, error)
+	retryAttempts     int
+	retryBackoff      time.Duration
+	isRetryable       func(error) bool
+	readOnlyPaths     []string
+	touchParents      bool
+	concurrency       chan struct{}
+	auditor           *auditor
+	auditReads        bool
+	encode            func([]byte) ([]byte, error)
+	decode            func([]byte) ([]byte, error)
+	strictReaddir     bool
+	mknodDevices      bool
+	maxFileSize       int64
+	readReplicas      []billy.Basic
+	nextReplica       uint64
+	onClose           func(path string, bytesWritten int64)
+	rootMode          *os.FileMode
+	overlayLower      billy.Basic
+	emitter           func(Event)
+	validateOpenFlags bool
+	memoryBudget      *memoryBudget
+	defaultTimestamps bool
+	defaultTime       time.Time
+	writeThroughAttrs bool
+	readOnlyAfter     *time.Time
+	liveness          *livenessProbe
+	stripPrefix       string
+	maxOpensPerPath   int
+	// openCounts is the number of open files per path for WithMaxOpensPerPath, protected by fdMtx.
+	openCounts        map[string]int
+	fileCounter       *fileCounter
+	chmodMask         *os.FileMode
+	strictChmodMask   bool
+	overlayWhiteouts  bool
+	noExec            bool
+	sidecars          *sidecarXattrs
+	readCache         *readCache
+	callerGroups      func() []uint32
+	truncateBlockSize int64
+	truncateRoundUp   bool
+	notExistAttempts  int
+	notExistDelay     time.Duration
+	releases          sync.WaitGroup
+	// generation is incremented for every modification through an open file.
+	generation uint64
+}
+
+// syncer is implemented by files that can flush their contents to stable storage, like *os.File.
+type syncer interface {
+	Sync() error
+}
+
+// Ping checks whether the underlying filesystem is reachable.
+func (w *wrapper) Ping() error {
+	_, err := w.backend().Stat("/")
+	if os.IsNotExist(err) {
+		// Some backends, like object stores, don't have an entry for the root. They answered, so they're up.
+		return nil
+	}
+	return err
+}
+
+// InvalidatePath drops everything cached about path.
+func (w *wrapper) InvalidatePath(path string) {
+	path, errc := cleanPath(path)
+	if errc != 0 {
+		return
+	}
+	w.invalidateAttrs(path)
+	w.invalidateReadAhead(path)
+	w.invalidateReadCache(path)
 }
 
 // Init is called when the file system is created.
 func (w *wrapper) Init() {
+	if w.liveness != nil {
+		w.liveness.started = true
+		go w.liveness.run(w.Ping)
+	}
+	if w.ready != nil {
+		w.ready()
+	}
 }
 
 // Destroy is called when the file system is destroyed.
 func (w *wrapper) Destroy() {
+	// Let files released with WithAsyncRelease finish closing.
+	w.releases.Wait()
+	if w.liveness != nil && w.liveness.started {
+		close(w.liveness.stop)
+		<-w.liveness.done
+	}
 }
 
-// Statfs gets file system statistics.
-func (w *wrapper) Statfs(path string, stat *fuse.Statfs_t) int {
-	return -fuse.ENOSYS
+// Mknoder can be implemented by a billy filesystem that can create special files, like FIFOs and device nodes.
+// mode includes the file type as one of the fuse.S_IF* constants, and dev is the device number given by the kernel.
+type Mknoder interface {
+	Mknod(path string, mode uint32, dev uint64) error
 }
 
 // Mknod creates a file node.
+// Regular files are created with OpenFile. Other types need a backend that implements Mknoder, and device nodes
+// also need WithMknodDevices. Otherwise we return EPERM, like the kernel does for unprivileged users.
 func (w *wrapper) Mknod(path string, mode uint32, dev uint64) int {
-	return -fuse.ENOSYS
+	path, errc := cleanPath(path)
+	if errc != 0 {
+		return errc
+	}
+	if w.isReadOnly(path) || w.isVirtual(path) {
+		return -fuse.EROFS
+	}
+	defer w.invalidateAttrs(path)
+	switch mode & fuse.S_IFMT {
+	case 0, fuse.S_IFREG:
+		fh, err := w.backend().OpenFile(w.flatToBackend(path), os.O_WRONLY|os.O_CREATE|os.O_EXCL, fileModeFromFuse(mode))
+		if err != nil {
+			return convertError(err)
+		}
+		if err := fh.Close(); err != nil {
+			return convertError(err)
+		}
+	case fuse.S_IFCHR, fuse.S_IFBLK:
+		if !w.mknodDevices {
+			return -fuse.EPERM
+		}
+		fallthrough
+	default:
+		m, ok := w.backend().(Mknoder)
+		if !ok {
+			return -fuse.EPERM
+		}
+		if err := m.Mknod(w.flatToBackend(path), mode, dev); err != nil {
+			return convertError(err)
+		}
+	}
+	w.touchParent(path)
+	return 0
 }
 
 // Mkdir creates a directory.
 func (w *wrapper) Mkdir(path string, mode uint32) int {
-	if dfs, ok := w.underlying.(billy.Dir); ok {
-		return convertError(dfs.MkdirAll(path, os.FileMode(mode)))
+	path, errc := cleanPath(path)
+	if errc != 0 {
+		return errc
+	}
+	if w.isReadOnly(path) || w.isVirtual(path) {
+		return -fuse.EROFS
+	}
+	defer w.invalidateAttrs(path)
+	if dfs, ok := w.backend().(billy.Dir); ok {
+		if err := dfs.MkdirAll(w.flatToBackend(path), fileModeFromFuse(mode)); err != nil {
+			return convertError(err)
+		}
+		w.touchParent(path)
+		return 0
 	}
 	return -fuse.ENOSYS
 }
 
+// lockPaths serializes mutating operations on the given paths if WithPerPathLocking is used.
+func (w *wrapper) lockPaths(paths ...string) func() {
+	if w.pathLocks == nil {
+		return func() {}
+	}
+	return w.pathLocks.lock(paths...)
+}
+
 // Unlink removes a file.
 func (w *wrapper) Unlink(path string) int {
-	return convertError(w.underlying.Remove(path))
+	path, errc := cleanPath(path)
+	if errc != 0 {
+		return errc
+	}
+	if w.isReadOnly(path) {
+		return -fuse.EROFS
+	}
+	if _, ok := w.virtualContents(path); ok {
+		return -fuse.EROFS
+	}
+	defer w.invalidateAttrs(path)
+	defer w.lockPaths(path)()
+	defer w.invalidateReadCache(path)
+	bpath := w.flatToBackend(path)
+	// Remove removes directories too, so check that we aren't asked to unlink one.
+	if fi, err := w.lstat(bpath); err == nil && fi.IsDir() {
+		return -fuse.EISDIR
+	}
+	if err := w.backend().Remove(bpath); err != nil {
+		return convertError(err)
+	}
+	w.removeSidecar(path)
+	w.touchParent(path)
+	return 0
 }
 
 // Rmdir removes a directory.
 func (w *wrapper) Rmdir(path string) int {
-	return convertError(w.underlying.Remove(path))
+	path, errc := cleanPath(path)
+	if errc != 0 {
+		return errc
+	}
+	if w.isReadOnly(path) {
+		return -fuse.EROFS
+	}
+	defer w.invalidateAttrs(path)
+	bpath := w.flatToBackend(path)
+	// Remove removes files too, so check that we are asked to remove a directory.
+	if fi, err := w.lstat(bpath); err == nil && !fi.IsDir() {
+		return -fuse.ENOTDIR
+	}
+	if err := w.backend().Remove(bpath); err != nil {
+		return convertError(err)
+	}
+	w.removeSidecar(path)
+	w.touchParent(path)
+	return 0
+}
+
+// touchParent updates the modification time of the directory containing path after an entry was added or removed,
+// for backends that don't do that themselves. It only does something if WithTouchParentOnModify is used.
+func (w *wrapper) touchParent(path string) {
+	if !w.touchParents {
+		return
+	}
+	cfs, ok := w.backend().(billy.Change)
+	if !ok {
+		return
+	}
+	dir := gopath.Dir(w.flatToBackend(path))
+	now := w.now()
+	if err := cfs.Chtimes(dir, now, now); err != nil {
+		w.logErrno("Chtimes", dir, convertError(err))
+	}
+	w.invalidateAttrs(gopath.Dir(path))
 }
 
 // Link creates a hard link to a file.
@@ -73,217 +347,1374 @@ func (w *wrapper) Link(oldpath, newpath string) int {
 
 // Symlink creates a symbolic link.
 func (w *wrapper) Symlink(target, newpath string) int {
-	if sfs, ok := w.underlying.(billy.Symlink); ok {
-		return convertError(sfs.Symlink(target, newpath))
+	newpath, errc := cleanPath(newpath)
+	if errc != 0 {
+		return errc
+	}
+	if w.isReadOnly(newpath) || w.isVirtual(newpath) {
+		return -fuse.EROFS
+	}
+	defer w.invalidateAttrs(newpath)
+	if sfs, ok := w.backend().(billy.Symlink); ok {
+		bpath := w.flatToBackend(newpath)
+		// Not all backends report a collision in a way we recognize.
+		if _, err := sfs.Lstat(bpath); err == nil {
+			return -fuse.EEXIST
+		}
+		return convertError(sfs.Symlink(target, bpath))
 	}
 	return -fuse.ENOSYS
 }
 
 // Readlink reads the target of a symbolic link.
 func (w *wrapper) Readlink(path string) (int, string) {
-	if sfs, ok := w.underlying.(billy.Symlink); ok {
-		fn, err := sfs.Readlink(path)
-		if err != nil {
-			return convertError(err), ""
-		}
-		return 0, fn
+	path, errc := cleanPath(path)
+	if errc != 0 {
+		return errc, ""
 	}
-	return -fuse.ENOSYS, ""
+	if _, ok := w.backend().(billy.Symlink); !ok {
+		return -fuse.ENOSYS, ""
+	}
+	fn, err := w.readlink(w.flatToBackend(path))
+	if err != nil {
+		return convertError(err), ""
+	}
+	return 0, fn
+}
+
+// readlink reads the target of a symbolic link on the backend. path is the path on the backend.
+func (w *wrapper) readlink(path string) (string, error) {
+	return readlinkFS(w.backend(), path)
+}
+
+// readlinkFS reads the target of a symbolic link on fs.
+func readlinkFS(fs billy.Basic, path string) (string, error) {
+	sfs, ok := fs.(billy.Symlink)
+	if !ok {
+		return "", billy.ErrNotSupported
+	}
+	fn, err := sfs.Readlink(path)
+	if err != nil {
+		return "", err
+	}
+	// Backends on Windows might give us backslashes, which would confuse the kernel.
+	return filepath.ToSlash(fn), nil
 }
 
 // Rename renames a file.
 func (w *wrapper) Rename(oldpath, newpath string) int {
-	return convertError(w.underlying.Rename(oldpath, newpath))
+	oldpath, errc := cleanPath(oldpath)
+	if errc != 0 {
+		return errc
+	}
+	newpath, errc = cleanPath(newpath)
+	if errc != 0 {
+		return errc
+	}
+	if w.isReadOnly(oldpath, newpath) || w.isVirtual(oldpath, newpath) {
+		return -fuse.EROFS
+	}
+	defer w.lockPaths(oldpath, newpath)()
+	defer w.invalidateReadCache(oldpath)
+	defer w.invalidateReadCache(newpath)
+	boldpath, bnewpath := w.flatToBackend(oldpath), w.flatToBackend(newpath)
+	if errc := w.checkRename(boldpath, bnewpath); errc != 0 {
+		return errc
+	}
+	if boldpath == bnewpath {
+		// POSIX makes renaming a path onto itself a no-op. Backends might remove the file instead.
+		return 0
+	}
+	if err := w.backend().Rename(boldpath, bnewpath); err != nil {
+		return convertError(err)
+	}
+	w.renameSidecar(oldpath, newpath)
+	w.renameFileDescriptors(oldpath, newpath)
+	if w.attrCache != nil {
+		w.attrCache.invalidateTree(oldpath)
+		w.attrCache.invalidateTree(newpath)
+	}
+	return 0
+}
+
+// renameFileDescriptors updates the paths of open files after oldpath was renamed to newpath.
+func (w *wrapper) renameFileDescriptors(oldpath, newpath string) {
+	w.fdMtx.Lock()
+	defer w.fdMtx.Unlock()
+	prefix := strings.TrimSuffix(oldpath, "/") + "/"
+	for _, of := range w.fileDescriptors {
+		old := of.path
+		if of.path == oldpath {
+			of.path = newpath
+		} else if strings.HasPrefix(of.path, prefix) {
+			of.path = strings.TrimSuffix(newpath, "/") + "/" + of.path[len(prefix):]
+		}
+		if of.path != old {
+			w.moveOpenLocked(old, of.path)
+		}
+	}
+}
+
+// checkRename enforces the POSIX rules for renaming over existing paths, because many backends don't.
+// A missing source is ENOENT, because backends don't agree on that. Other errors from looking at the paths are left
+// for the backend's Rename to report. oldpath and newpath are paths on the backend.
+func (w *wrapper) checkRename(oldpath, newpath string) int {
+	src, err := w.lstat(oldpath)
+	if os.IsNotExist(err) {
+		return -fuse.ENOENT
+	}
+	if err != nil || oldpath == newpath {
+		return 0
+	}
+	if src.IsDir() && strings.HasPrefix(newpath, strings.TrimSuffix(oldpath, "/")+"/") {
+		return -fuse.EINVAL
+	}
+	dst, err := w.lstat(newpath)
+	if err != nil {
+		return 0
+	}
+	switch {
+	case !src.IsDir() && dst.IsDir():
+		return -fuse.EISDIR
+	case src.IsDir() && !dst.IsDir():
+		return -fuse.ENOTDIR
+	case src.IsDir() && dst.IsDir():
+		if dfs, ok := w.backend().(billy.Dir); ok {
+			entries, err := dfs.ReadDir(newpath)
+			if err == nil && len(entries) > 0 {
+				return -fuse.ENOTEMPTY
+			}
+		}
+	}
+	return 0
+}
+
+// lstat stats path without following a symlink at the end, if the backend supports symlinks.
+func (w *wrapper) lstat(path string) (os.FileInfo, error) {
+	if sfs, ok := w.backend().(billy.Symlink); ok {
+		return sfs.Lstat(path)
+	}
+	return w.backend().Stat(path)
 }
 
 // Chmod changes the permission bits of a file.
 func (w *wrapper) Chmod(path string, mode uint32) int {
-	if cfs, ok := w.underlying.(billy.Change); ok {
-		return convertError(cfs.Chmod(path, os.FileMode(mode)))
+	path, errc := cleanPath(path)
+	if errc != 0 {
+		return errc
+	}
+	if w.isReadOnly(path) || w.isVirtual(path) {
+		return -fuse.EROFS
+	}
+	m := fileModeFromFuse(mode)
+	if w.chmodMask != nil && m&^*w.chmodMask != 0 {
+		if w.strictChmodMask {
+			return -fuse.EPERM
+		}
+		m &= *w.chmodMask
+	}
+	defer w.invalidateAttrs(path)
+	defer w.lockPaths(path)()
+	if cfs, ok := w.backend().(billy.Change); ok {
+		return convertError(cfs.Chmod(w.flatToBackend(path), m))
 	}
 	return -fuse.ENOSYS
 }
 
 // Chown changes the owner and group of a file.
+// If the backend can't change owners we return EPERM, which is what chown(1) and friends expect from an unprivileged chown.
 func (w *wrapper) Chown(path string, uid uint32, gid uint32) int {
-	if cfs, ok := w.underlying.(billy.Change); ok {
-		return convertError(cfs.Chown(path, int(uid), int(gid)))
+	path, errc := cleanPath(path)
+	if errc != 0 {
+		return errc
 	}
-	return -fuse.ENOSYS
+	if w.isReadOnly(path) || w.isVirtual(path) {
+		return -fuse.EROFS
+	}
+	defer w.invalidateAttrs(path)
+	if cfs, ok := w.backend().(billy.Change); ok {
+		return convertError(cfs.Chown(w.flatToBackend(path), chownID(uid), chownID(gid)))
+	}
+	return -fuse.EPERM
+}
+
+// chownID converts a uid or gid for billy.Change.Chown. The kernel uses -1 for "don't change", which os.Chown expects as a negative int.
+func chownID(id uint32) int {
+	if id == ^uint32(0) {
+		return -1
+	}
+	return int(id)
 }
 
 // Utimens changes the access and modification times of a file.
 func (w *wrapper) Utimens(path string, tmsp []fuse.Timespec) int {
-	if cfs, ok := w.underlying.(billy.Change); ok {
+	path, errc := cleanPath(path)
+	if errc != 0 {
+		return errc
+	}
+	if w.isReadOnly(path) || w.isVirtual(path) {
+		return -fuse.EROFS
+	}
+	defer w.invalidateAttrs(path)
+	if cfs, ok := w.backend().(billy.Change); ok {
+		bpath := w.flatToBackend(path)
+		if tmsp == nil {
+			// utimensat(2) with NULL times sets both to the current time.
+			now := w.now()
+			return convertError(cfs.Chtimes(bpath, now, now))
+		}
 		if len(tmsp) != 2 {
 			return -fuse.EINVAL
 		}
-		return convertError(cfs.Chtimes(path, tmsp[0].Time(), tmsp[1].Time()))
+		return convertError(cfs.Chtimes(bpath, tmsp[0].Time(), tmsp[1].Time()))
 	}
 	return -fuse.ENOSYS
 }
 
-// Access checks file access permissions.
-func (w *wrapper) Access(path string, mask uint32) int {
-	return -fuse.ENOSYS
+// openFile is an entry in the file descriptor table.
+type openFile struct {
+	file      billy.File
+	path      string
+	flags     int
+	readAhead *readAhead
+	fsync     *fsyncBatcher
+	openedAt  time.Time
+	// positioned is whether file supports ReadAt and WriteAt. If not, reads and writes Seek under the write lock.
+	positioned bool
+	// seekMtx is held while a seekFile uses the file position of file.
+	seekMtx sync.Mutex
+	// bytesWritten counts the bytes written through this file, for WithOnClose.
+	bytesWritten int64
+	// knownSize is the size writes through this file gave it, for WithWriteThroughAttrUpdate.
+	knownSize int64
+	// generation is the value of wrapper.generation at the last modification through this file.
+	generation uint64
+
+	latchedMtx sync.Mutex
+	// latched is an error from a partially successful write, which wasn't reported to the application yet.
+	latched error
+}
+
+// latchError remembers err from a write that reported a short count, to be reported when the file is closed.
+func (of *openFile) latchError(err error) {
+	of.latchedMtx.Lock()
+	defer of.latchedMtx.Unlock()
+	if of.latched == nil {
+		of.latched = err
+	}
+}
+
+// takeLatchedError returns the latched error, if any, and clears it so it's only reported once.
+func (of *openFile) takeLatchedError() error {
+	of.latchedMtx.Lock()
+	defer of.latchedMtx.Unlock()
+	err := of.latched
+	of.latched = nil
+	return err
 }
 
-func (w *wrapper) createFileDescriptor(fh billy.File) uint64 {
+func (w *wrapper) createFileDescriptor(path string, flags int, fh billy.File) uint64 {
+	positioned := supportsPositionedIO(fh)
 	w.fdMtx.Lock()
 	defer w.fdMtx.Unlock()
 	w.nextFd++
 	fd := w.nextFd
-	w.fileDescriptors[fd] = fh
+	of := &openFile{
+		file:       fh,
+		path:       path,
+		flags:      flags,
+		openedAt:   w.now(),
+		positioned: positioned,
+	}
+	if w.readAheadSize > 0 {
+		of.readAhead = newReadAhead(w.readAheadSize, w.memoryBudget, w.readTimeout)
+	}
+	if sf, ok := fh.(syncer); ok && w.fsyncWindow > 0 {
+		of.fsync = newFsyncBatcher(sf, w.fsyncWindow)
+	}
+	w.fileDescriptors[fd] = of
 	w.writeLocks[fd] = new(sync.Mutex)
+	w.checkTableLocked()
 	return fd
 }
 
-func (w *wrapper) getFileDescriptor(fd uint64) (billy.File, bool) {
+func (w *wrapper) getFileDescriptor(fd uint64) (*openFile, bool) {
+	w.fdMtx.Lock()
+	defer w.fdMtx.Unlock()
+	of, ok := w.fileDescriptors[fd]
+	if !ok {
+		return nil, false
+	}
+	if w.debugChecks && w.writeLocks[fd] == nil {
+		w.violation("file descriptor %d has no write lock", fd)
+	}
+	return of, true
+}
+
+// invalidateReadAhead drops prefetched data of all file descriptors for path.
+func (w *wrapper) invalidateReadAhead(path string) {
+	if w.readAheadSize == 0 {
+		return
+	}
 	w.fdMtx.Lock()
 	defer w.fdMtx.Unlock()
-	fh, ok := w.fileDescriptors[fd]
-	return fh, ok
+	for _, of := range w.fileDescriptors {
+		if of.path == path {
+			of.readAhead.invalidate()
+		}
+	}
 }
 
-func (w *wrapper) getFileDescriptorWithLock(fd uint64) (billy.File, func(), bool) {
+// findWritableFileDescriptor returns an open file for path that was opened for writing.
+func (w *wrapper) findWritableFileDescriptor(path string) (uint64, *openFile, bool) {
 	w.fdMtx.Lock()
 	defer w.fdMtx.Unlock()
-	fh, ok := w.fileDescriptors[fd]
-	w.writeLocks[fd].Lock()
-	unlock := w.writeLocks[fd].Unlock
-	return fh, unlock, ok
+	for fd, of := range w.fileDescriptors {
+		if of.path == path && of.flags&fuse.O_ACCMODE != fuse.O_RDONLY {
+			return fd, of, true
+		}
+	}
+	return 0, nil, false
+}
+
+func (w *wrapper) getFileDescriptorWithLock(fd uint64) (*openFile, func(), bool) {
+	w.fdMtx.Lock()
+	defer w.fdMtx.Unlock()
+	of, ok := w.fileDescriptors[fd]
+	if !ok {
+		return nil, nil, false
+	}
+	l := w.writeLocks[fd]
+	if l == nil {
+		w.violation("file descriptor %d has no write lock", fd)
+		return nil, nil, false
+	}
+	l.Lock()
+	return of, l.Unlock, true
 }
 
 // Create creates and opens a file.
 // The flags are a combination of the fuse.O_* constants.
 func (w *wrapper) Create(path string, flags int, mode uint32) (int, uint64) {
-	fh, err := w.underlying.OpenFile(path, flags|os.O_CREATE|os.O_RDWR, os.FileMode(mode))
+	path, errc := cleanPath(path)
+	if errc != 0 {
+		return errc, 0
+	}
+	if w.isReadOnly(path) {
+		return -fuse.EROFS, 0
+	}
+	if errc := w.checkOpenFlags(flags | os.O_CREATE); errc != 0 {
+		return errc, 0
+	}
+	if !w.reserveOpen(path) {
+		return -fuse.EMFILE, 0
+	}
+	errc, fd := w.create(path, flags, mode)
+	if errc != 0 {
+		w.unreserveOpen(path)
+	}
+	return errc, fd
+}
+
+func (w *wrapper) create(path string, flags int, mode uint32) (int, uint64) {
+	defer w.invalidateReadCache(path)
+	if _, ok := w.virtualContents(path); ok {
+		return -fuse.EROFS, 0
+	}
+	flags |= os.O_CREATE | os.O_RDWR
+	bpath := w.flatToBackend(path)
+	if errc := w.checkNofollow(bpath, flags); errc != 0 {
+		return errc, 0
+	}
+	fh, err := w.openFile(bpath, flags, fileModeFromFuse(mode))
+	w.invalidateAttrs(path)
 	if err != nil {
-		return convertError(err), 0
+		errc := convertError(err)
+		if errc == -fuse.EIO {
+			// Not all backends report a missing parent directory in a way we recognize.
+			if _, err := w.backend().Stat(gopath.Dir(bpath)); os.IsNotExist(err) {
+				errc = -fuse.ENOENT
+			}
+		}
+		return errc, 0
 	}
-	return 0, w.createFileDescriptor(fh)
+	w.touchParent(path)
+	fd := w.createFileDescriptor(path, flags, fh)
+	// The kernel asks for the attributes of a new file right away.
+	w.primeAttrs(path)
+	return 0, fd
 }
 
 // Open opens a file.
 // The flags are a combination of the fuse.O_* constants.
+// Open never creates files, even if the backend would let it; that's what Create is for.
 func (w *wrapper) Open(path string, flags int) (int, uint64) {
-	fh, err := w.underlying.OpenFile(path, flags|os.O_RDONLY, 0777)
+	path, errc := cleanPath(path)
+	if errc != 0 {
+		return errc, 0
+	}
+	if flags&(os.O_WRONLY|os.O_RDWR|os.O_TRUNC|os.O_APPEND) != 0 && w.isReadOnly(path) {
+		return -fuse.EROFS, 0
+	}
+	if errc := w.checkOpenFlags(flags); errc != 0 {
+		return errc, 0
+	}
+	if !w.reserveOpen(path) {
+		return -fuse.EMFILE, 0
+	}
+	errc, fd := w.open(path, flags)
+	if errc != 0 {
+		w.unreserveOpen(path)
+	}
+	return errc, fd
+}
+
+func (w *wrapper) open(path string, flags int) (int, uint64) {
+	if flags&os.O_TRUNC != 0 {
+		defer w.invalidateReadCache(path)
+	}
+	flags = flags&^os.O_CREATE | os.O_RDONLY
+	if contents, ok := w.virtualContents(path); ok {
+		return w.openVirtual(path, flags, contents)
+	}
+	bpath := w.flatToBackend(path)
+	if errc := w.checkNofollow(bpath, flags); errc != 0 {
+		return errc, 0
+	}
+	var fh billy.File
+	err := w.retryNotExist(func() error {
+		var err error
+		fh, err = w.openFile(bpath, flags, 0777)
+		return err
+	})
+	if os.IsNotExist(err) {
+		if real, ok := w.resolveCase(bpath); ok {
+			fh, err = w.openFile(real, flags, 0777)
+		}
+	}
 	if err != nil {
 		return convertError(err), 0
 	}
-	return 0, w.createFileDescriptor(fh)
+	return 0, w.createFileDescriptor(path, flags, fh)
+}
+
+// checkOpenFlags implements WithOpenFlagsValidation. It returns EINVAL for flag combinations that make no sense,
+// and EROFS for flags that need write access if the backend doesn't have billy.WriteCapability.
+func (w *wrapper) checkOpenFlags(flags int) int {
+	if !w.validateOpenFlags {
+		return 0
+	}
+	switch flags & fuse.O_ACCMODE {
+	case fuse.O_RDONLY:
+		if flags&fuse.O_TRUNC != 0 {
+			return -fuse.EINVAL
+		}
+	case fuse.O_WRONLY, fuse.O_RDWR:
+	default:
+		return -fuse.EINVAL
+	}
+	if flags&(fuse.O_WRONLY|fuse.O_RDWR|fuse.O_CREAT|fuse.O_TRUNC|fuse.O_APPEND) != 0 && !billy.CapabilityCheck(w.backend(), billy.WriteCapability) {
+		return -fuse.EROFS
+	}
+	return 0
+}
+
+// checkNofollow returns ELOOP if O_NOFOLLOW is given and path is a symlink.
+func (w *wrapper) checkNofollow(path string, flags int) int {
+	if flags&oNofollow == 0 {
+		return 0
+	}
+	sfs, ok := w.backend().(billy.Symlink)
+	if !ok {
+		return 0
+	}
+	fi, err := sfs.Lstat(path)
+	if err != nil {
+		// Let OpenFile report the error.
+		return 0
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return -fuse.ELOOP
+	}
+	return 0
+}
+
+// openFile calls OpenFile on the underlying filesystem, retrying if it gets interrupted or fails with an error
+// WithRetry considers transient.
+// With WithOpenTimeout, each attempt gives up after the timeout and closes the file if it gets opened later.
+func (w *wrapper) openFile(path string, flags int, mode os.FileMode) (billy.File, error) {
+	var fh billy.File
+	err := w.retry(func() error {
+		var err error
+		fh, err = w.openFileTimeout(path, flags, mode)
+		return err
+	})
+	return fh, err
+}
+
+func (w *wrapper) openFileTimeout(path string, flags int, mode os.FileMode) (billy.File, error) {
+	release, err := w.acquire(w.openTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if w.openTimeout <= 0 {
+		return w.openFileNow(path, flags, mode)
+	}
+	type result struct {
+		fh  billy.File
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		fh, err := w.openFileNow(path, flags, mode)
+		ch <- result{fh, err}
+	}()
+	t := time.NewTimer(w.openTimeout)
+	defer t.Stop()
+	select {
+	case r := <-ch:
+		return r.fh, r.err
+	case <-t.C:
+		go func() {
+			if r := <-ch; r.err == nil {
+				w.closeAndLog("Open", path, r.fh)
+			}
+		}()
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrDeadlineExceeded}
+	}
+}
+
+func (w *wrapper) openFileNow(path string, flags int, mode os.FileMode) (billy.File, error) {
+	var fh billy.File
+	err := retryEINTR(func() error {
+		if flags&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+			var err error
+			fh, err = w.backend().OpenFile(path, flags, mode)
+			return err
+		}
+		return w.onReadReplica(func(fs billy.Basic) error {
+			var err error
+			fh, err = fs.OpenFile(path, flags, mode)
+			return err
+		})
+	})
+	return fh, err
+}
+
+// FileStater can be implemented by files of a billy filesystem to stat an open file, like *os.File does.
+// It works even if the file was unlinked or renamed, and saves a path lookup.
+type FileStater interface {
+	Stat() (os.FileInfo, error)
+}
+
+// statFile stats the open file fh, through FileStater if it implements that.
+func (w *wrapper) statFile(path string, fh billy.File) (os.FileInfo, error) {
+	if fs, ok := fh.(FileStater); ok {
+		return fs.Stat()
+	}
+	return w.backend().Stat(w.flatToBackend(path))
 }
 
 // Getattr gets file attributes.
-// Note that Billy doesn't support Stat on a filedescriptor, so we ignore the fd.
+// Billy doesn't support Stat on a filedescriptor, so we only use the fd if the file implements FileStater.
 func (w *wrapper) Getattr(path string, stat *fuse.Stat_t, fd uint64) int {
-	fi, err := w.underlying.Stat(path)
+	path, errc := cleanPath(path)
+	if errc != 0 {
+		return errc
+	}
+	if errc := w.getattrFd(path, stat, fd); errc != 0 {
+		return errc
+	}
+	w.applyKnownSize(path, stat)
+	return 0
+}
+
+func (w *wrapper) getattrFd(path string, stat *fuse.Stat_t, fd uint64) int {
+	if contents, ok := w.virtualContents(path); ok {
+		fi, err := w.statVirtual(path, contents)
+		if err != nil {
+			return convertError(err)
+		}
+		w.fileInfoToStat(fi, stat)
+		return 0
+	}
+	if fd != ^uint64(0) {
+		if of, ok := w.getFileDescriptor(fd); ok {
+			if fs, ok := of.file.(FileStater); ok {
+				fi, err := fs.Stat()
+				if err != nil {
+					return convertError(err)
+				}
+				w.fileInfoToStat(fi, stat)
+				return 0
+			}
+		}
+	}
+	if w.attrCache == nil {
+		return w.getattr(path, stat)
+	}
+	gen := w.pathGeneration(path)
+	if st, ok := w.attrCache.get(path, gen, w.now()); ok {
+		*stat = st
+		return 0
+	}
+	if errc := w.getattr(path, stat); errc != 0 {
+		return errc
+	}
+	w.attrCache.put(path, *stat, gen, w.now())
+	return 0
+}
+
+func (w *wrapper) getattr(path string, stat *fuse.Stat_t) int {
+	path = w.flatToBackend(path)
+	fi, err := w.getattrStat(path)
+	if os.IsNotExist(err) {
+		if path == "/" {
+			// Some backends, like object stores, don't have an entry for the root. It exists regardless.
+			*stat = fuse.Stat_t{Mode: fuse.S_IFDIR | 0755, Uid: w.uid, Gid: w.gid}
+			w.setRootMode(stat)
+			return 0
+		}
+		if real, ok := w.resolveCase(path); ok {
+			path = real
+			fi, err = w.getattrStat(path)
+		}
+	}
 	if err != nil {
 		return convertError(err)
 	}
-	fileInfoToStat(fi, stat)
+	w.fileInfoToStat(fi, stat)
+	w.setSymlinkSize(path, stat)
+	if path == "/" {
+		w.setRootMode(stat)
+	}
 	return 0
 }
 
+// setRootMode applies WithRootMode to the attributes of the root.
+func (w *wrapper) setRootMode(stat *fuse.Stat_t) {
+	if w.rootMode != nil {
+		stat.Mode = fuse.S_IFDIR | fileModeToFuse(*w.rootMode)&^fuse.S_IFMT
+	}
+}
+
+// setSymlinkSize sets the size of a symlink to the length of its target, as POSIX requires.
+// path is the path on the backend.
+func (w *wrapper) setSymlinkSize(path string, stat *fuse.Stat_t) {
+	if stat.Mode&fuse.S_IFMT != fuse.S_IFLNK {
+		return
+	}
+	if target, err := w.readlink(path); err == nil {
+		stat.Size = int64(len(target))
+	}
+}
+
+// getattrStat stats path for Getattr, following symlinks unless WithFollowSymlinks(false) was given, and retrying
+// with WithOpenRetryOnNotExist.
+func (w *wrapper) getattrStat(path string) (os.FileInfo, error) {
+	if path == "/" {
+		// Backends without an entry for the root don't grow one later.
+		return w.getattrStatOnce(path)
+	}
+	var fi os.FileInfo
+	err := w.retryNotExist(func() error {
+		var err error
+		fi, err = w.getattrStatOnce(path)
+		return err
+	})
+	return fi, err
+}
+
+func (w *wrapper) getattrStatOnce(path string) (os.FileInfo, error) {
+	var fi os.FileInfo
+	err := w.retry(func() error {
+		release, err := w.acquire(0)
+		if err != nil {
+			return err
+		}
+		defer release()
+		return w.onReadReplica(func(fs billy.Basic) error {
+			var err error
+			if !w.followSymlinks {
+				fi, err = lstatFS(fs, path)
+			} else {
+				fi, err = statFollow(fs, path)
+			}
+			return err
+		})
+	})
+	return fi, err
+}
+
+// maxSymlinks is how many symlinks statFollow follows before giving up, like the kernel's MAXSYMLINKS.
+const maxSymlinks = 40
+
+// statFollow stats path on fs, following symlinks at the end of the path itself rather than trusting the backend
+// not to loop forever on circular links. Too many links result in ELOOP.
+func statFollow(fs billy.Basic, path string) (os.FileInfo, error) {
+	if _, ok := fs.(billy.Symlink); !ok {
+		return fs.Stat(path)
+	}
+	p := path
+	var link os.FileInfo
+	for i := 0; i <= maxSymlinks; i++ {
+		fi, err := lstatFS(fs, p)
+		if os.IsNotExist(err) && link != nil {
+			// A dangling symlink. Report the link itself, so ls -l can still show it.
+			return link, nil
+		}
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			return fi, err
+		}
+		if link == nil {
+			link = fi
+		}
+		target, err := readlinkFS(fs, p)
+		if err != nil {
+			return nil, err
+		}
+		if !gopath.IsAbs(target) {
+			target = gopath.Join(gopath.Dir(p), target)
+		}
+		p = target
+	}
+	return nil, &os.PathError{Op: "stat", Path: path, Err: syscall.ELOOP}
+}
+
 // Truncate changes the size of a file.
 func (w *wrapper) Truncate(path string, size int64, fd uint64) int {
+	path, errc := cleanPath(path)
+	if errc != 0 {
+		return errc
+	}
+	if w.isReadOnly(path) {
+		return -fuse.EROFS
+	}
+	if w.discardWrites {
+		return 0
+	}
+	if _, ok := w.virtualContents(path); ok {
+		return -fuse.EROFS
+	}
+	size = w.alignTruncate(size)
+	if w.maxFileSize > 0 && size > w.maxFileSize {
+		return -fuse.EFBIG
+	}
+	defer w.lockPaths(path)()
+	defer w.invalidateReadCache(path)
 	if fd != ^uint64(0) {
-		fh, ok := w.getFileDescriptor(fd)
+		of, ok := w.getFileDescriptor(fd)
 		if !ok {
 			return -fuse.EINVAL
 		}
-		return convertError(fh.Truncate(size))
+		w.invalidateReadAhead(path)
+		defer w.bumpGeneration(of)
+		return w.truncateFd(path, fd, of, size)
 	}
-	// Billy doesn't support Truncate on a path.
-	fh, err := w.underlying.OpenFile(path, os.O_WRONLY, 0777)
+	w.invalidateReadAhead(path)
+	defer w.invalidateAttrs(path)
+	// Billy doesn't support Truncate on a path. Reuse a file that is already open for writing
+	// if we have one, so we don't have the side effects of opening it again.
+	if fd, of, ok := w.findWritableFileDescriptor(path); ok {
+		defer w.bumpGeneration(of)
+		return w.truncateFd(path, fd, of, size)
+	}
+	fh, err := w.backend().OpenFile(w.flatToBackend(path), os.O_WRONLY, 0777)
 	if err != nil {
 		return convertError(err)
 	}
-	defer fh.Close()
-	return convertError(fh.Truncate(size))
+	defer w.closeAndLog("Truncate", path, fh)
+	return convertError(w.truncate(path, fh, size))
+}
+
+// alignTruncate rounds size to a multiple of the WithTruncateBlockAlign block size.
+func (w *wrapper) alignTruncate(size int64) int64 {
+	bs := w.truncateBlockSize
+	if bs <= 0 || size%bs == 0 {
+		return size
+	}
+	size -= size % bs
+	if w.truncateRoundUp {
+		size += bs
+	}
+	return size
+}
+
+// truncateFd truncates the file open as fd. Files without positioned I/O are extended with a Seek and Write, so that
+// takes the write lock of the file descriptor like Write does.
+func (w *wrapper) truncateFd(path string, fd uint64, of *openFile, size int64) int {
+	if !of.positioned {
+		_, unlock, ok := w.getFileDescriptorWithLock(fd)
+		if !ok {
+			return -fuse.EINVAL
+		}
+		defer unlock()
+		// A Read or Write that timed out might still be using the file position.
+		of.seekMtx.Lock()
+		defer of.seekMtx.Unlock()
+	}
+	return convertError(w.truncate(path, of.file, size))
+}
+
+// truncate sets the size of fh. Some backends ignore growing a file with Truncate, so in that case we
+// extend it ourselves by writing a zero byte at the end. With WithContentTransform, the whole extension is written.
+func (w *wrapper) truncate(path string, fh billy.File, size int64) error {
+	oldSize := int64(-1)
+	if w.encode != nil {
+		if fi, err := w.statFile(path, fh); err == nil {
+			oldSize = fi.Size()
+		}
+	}
+	if err := fh.Truncate(size); err != nil {
+		return err
+	}
+	w.setKnownSize(path, size)
+	if oldSize >= 0 && oldSize < size {
+		// The zero bytes the file is extended with are file content like any other, so they're stored encoded.
+		return w.fillEncodedZeros(fh, oldSize, size)
+	}
+	fi, err := w.statFile(path, fh)
+	if err != nil || fi.Size() >= size {
+		return nil
+	}
+	_, err = writeAt(fh, []byte{0}, size-1)
+	return err
+}
+
+// fillEncodedZeros writes zero bytes encoded with WithContentTransform from start up to end.
+func (w *wrapper) fillEncodedZeros(fh billy.File, start, end int64) error {
+	for ofst := start; ofst < end; {
+		n := end - ofst
+		if n > 64<<10 {
+			n = 64 << 10
+		}
+		fill, err := transform(w.encode, make([]byte, n))
+		if err != nil {
+			return err
+		}
+		if _, err := writeAt(fh, fill, ofst); err != nil {
+			return err
+		}
+		ofst += n
+	}
+	return nil
 }
 
 // Read reads data from a file.
 func (w *wrapper) Read(path string, buff []byte, ofst int64, fd uint64) int {
-	fh, ok := w.getFileDescriptor(fd)
+	path, errc := cleanPath(path)
+	if errc != 0 {
+		return errc
+	}
+	w.checkOffset("Read", ofst)
+	if len(buff) == 0 {
+		// Backends disagree on what an empty ReadAt returns, so don't ask them.
+		return 0
+	}
+	of, ok := w.getFileDescriptor(fd)
 	if !ok {
 		return -fuse.EINVAL
 	}
-	n, err := fh.ReadAt(buff, ofst)
+	fh := of.file
+	// locked runs f, which uses fh. Reads and writes of files without positioned I/O Seek to their offset, so for
+	// those it holds the write lock to not interleave. It isn't held while waiting for a prefetch, which takes it too.
+	locked := func(f func()) bool {
+		if of.positioned {
+			f()
+			return true
+		}
+		_, unlock, ok := w.getFileDescriptorWithLock(fd)
+		if !ok {
+			return false
+		}
+		defer unlock()
+		f()
+		return true
+	}
+	if !of.positioned {
+		fh = seekFile{fh, &of.seekMtx}
+	}
+	prefetch := func(buff []byte, ofst int64) (n int, err error) {
+		if !locked(func() { n, err = w.readAtBackend(fh, buff, ofst) }) {
+			return 0, os.ErrClosed
+		}
+		return n, err
+	}
+	_, virtual := of.file.(*virtualFile)
+	var n int
+	cached := false
+	if w.readCache != nil && !virtual {
+		if !locked(func() { n, cached = w.readCached(path, fh, buff, ofst) }) {
+			return -fuse.EINVAL
+		}
+	}
+	switch {
+	case cached:
+	case of.readAhead != nil:
+		var ok bool
+		n, ok = of.readAhead.read(buff, ofst)
+		if !ok && !locked(func() { n = w.readAt(path, fh, buff, ofst) }) {
+			return -fuse.EINVAL
+		}
+		if n > 0 {
+			of.readAhead.done(prefetch, ofst, n)
+		}
+	default:
+		if !locked(func() { n = w.readAt(path, fh, buff, ofst) }) {
+			return -fuse.EINVAL
+		}
+	}
+	if n > 0 && w.decode != nil && !virtual {
+		out, err := transform(w.decode, buff[:n])
+		if err != nil {
+			return convertError(err)
+		}
+		copy(buff, out)
+	}
+	return n
+}
+
+// readAt reads from fh and returns the number of bytes read or a negative errno.
+func (w *wrapper) readAt(path string, fh billy.File, buff []byte, ofst int64) int {
+	return chunked(buff, ofst, w.maxReadSize, func(buff []byte, ofst int64) int {
+		return w.readChunk(path, fh, buff, ofst)
+	})
+}
+
+// readChunk does a single ReadAt call on the backend.
+func (w *wrapper) readChunk(path string, fh billy.File, buff []byte, ofst int64) int {
+	n, err := w.readAtBackend(fh, buff, ofst)
+	if err == nil && n < len(buff) {
+		// io.ReaderAt requires an error for short reads. Backends that don't give one skipped over a hole.
+		n = w.fillHole(path, fh, buff, ofst, n)
+	}
+	// Return whatever data we got, even if the backend failed halfway (e.g. io.ErrUnexpectedEOF from a truncated
+	// response). The kernel will ask for the rest, and get the error if it persists.
 	if n > 0 || err == io.EOF {
 		return n
 	}
 	return convertError(err)
 }
 
+// readAtBackend calls ReadAt on the backend, giving up after the WithReadTimeout duration and retrying transient
+// errors if WithRetry is used.
+func (w *wrapper) readAtBackend(fh billy.File, buff []byte, ofst int64) (int, error) {
+	var n int
+	err := w.retry(func() error {
+		var err error
+		n, err = w.readAtTimeout(fh, buff, ofst)
+		return err
+	})
+	return n, err
+}
+
+func (w *wrapper) readAtTimeout(fh billy.File, buff []byte, ofst int64) (int, error) {
+	release, err := w.acquire(w.readTimeout)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	if w.readTimeout <= 0 {
+		return readAt(fh, buff, ofst)
+	}
+	// A ReadAt that timed out might still write to its buffer later, so it doesn't get ours.
+	private := make([]byte, len(buff))
+	n, err := withTimeout(w.readTimeout, func() (int, error) {
+		return readAt(fh, private, ofst)
+	})
+	copy(buff, private[:n])
+	return n, err
+}
+
+// readAt reads from fh at ofst, retrying on EINTR.
+func readAt(fh billy.File, buff []byte, ofst int64) (int, error) {
+	var n int
+	err := retryEINTR(func() error {
+		var err error
+		n, err = fh.ReadAt(buff, ofst)
+		return err
+	})
+	return n, err
+}
+
+// withTimeout calls f, but gives up after d and returns os.ErrDeadlineExceeded.
+// f can't be interrupted, so if it never returns, its goroutine is leaked.
+func withTimeout(d time.Duration, f func() (int, error)) (int, error) {
+	type result struct {
+		n   int
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		n, err := f()
+		ch <- result{n, err}
+	}()
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case r := <-ch:
+		return r.n, r.err
+	case <-t.C:
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+// fillHole zeroes buff from n up to the end of the file, and returns the new number of bytes read.
+func (w *wrapper) fillHole(path string, fh billy.File, buff []byte, ofst int64, n int) int {
+	fi, err := w.statFile(path, fh)
+	if err != nil {
+		return n
+	}
+	end := fi.Size() - ofst
+	if end > int64(len(buff)) {
+		end = int64(len(buff))
+	}
+	for i := n; i < int(end); i++ {
+		buff[i] = 0
+	}
+	if int(end) > n {
+		return int(end)
+	}
+	return n
+}
+
 // Write writes data to a file.
 func (w *wrapper) Write(path string, buff []byte, ofst int64, fd uint64) int {
-	fh, unlock, ok := w.getFileDescriptorWithLock(fd)
+	path, errc := cleanPath(path)
+	if errc != 0 {
+		return errc
+	}
+	if w.isReadOnly(path) {
+		return -fuse.EROFS
+	}
+	w.checkOffset("Write", ofst)
+	if len(buff) == 0 {
+		return 0
+	}
+	if w.maxFileSize > 0 && ofst+int64(len(buff)) > w.maxFileSize {
+		return -fuse.EFBIG
+	}
+	if w.discardWrites {
+		if _, ok := w.getFileDescriptor(fd); !ok {
+			return -fuse.EINVAL
+		}
+		return len(buff)
+	}
+	if w.encode != nil {
+		out, err := transform(w.encode, buff)
+		if err != nil {
+			return convertError(err)
+		}
+		buff = out
+	}
+	defer w.lockPaths(path)()
+	of, unlock, ok := w.getFileDescriptorWithLock(fd)
 	if !ok {
 		return -fuse.EINVAL
 	}
-	if wa, ok := fh.(io.WriterAt); ok {
+	fh := of.file
+	w.invalidateReadAhead(path)
+	defer w.invalidateReadCache(path)
+	defer w.bumpGeneration(of)
+	if of.positioned {
+		// WriteAt doesn't use the file position, so concurrent writes are fine.
 		unlock()
-		n, err := wa.WriteAt(buff, ofst)
-		if err != nil {
+	} else {
+		defer unlock()
+		fh = seekFile{fh, &of.seekMtx}
+	}
+	return chunked(buff, ofst, w.maxWriteSize, func(buff []byte, ofst int64) int {
+		n, err := w.writeAtBackend(fh, buff, ofst)
+		if err != nil && n == 0 {
 			return convertError(err)
 		}
+		// Report the bytes that did make it, like write(2). If the error persists (e.g. ENOSPC),
+		// the application gets it from the next Write. Otherwise it gets it when closing the file.
+		if err != nil {
+			of.latchError(err)
+		}
+		atomic.AddInt64(&of.bytesWritten, int64(n))
+		w.noteSize(of, ofst+int64(n))
 		return n
+	})
+}
+
+// writeAtBackend calls writeAt, giving up after the WithWriteTimeout duration and retrying transient errors if
+// WithRetry is used. Writes are positioned, so repeating a partially failed one is harmless.
+func (w *wrapper) writeAtBackend(fh billy.File, buff []byte, ofst int64) (int, error) {
+	var n int
+	err := w.retry(func() error {
+		var err error
+		n, err = w.writeAtTimeout(fh, buff, ofst)
+		return err
+	})
+	return n, err
+}
+
+func (w *wrapper) writeAtTimeout(fh billy.File, buff []byte, ofst int64) (int, error) {
+	release, err := w.acquire(w.writeTimeout)
+	if err != nil {
+		return 0, err
 	}
-	defer unlock()
-	if _, err := fh.Seek(ofst, io.SeekStart); err != nil {
-		return convertError(err)
+	defer release()
+	if w.writeTimeout <= 0 {
+		return writeAt(fh, buff, ofst)
 	}
-	n, err := fh.Write(buff)
-	if err != nil {
-		return convertError(err)
+	// The kernel reuses buff once we return, so a write that timed out needs its own copy.
+	private := append([]byte(nil), buff...)
+	return withTimeout(w.writeTimeout, func() (int, error) {
+		return writeAt(fh, private, ofst)
+	})
+}
+
+// writeAt writes buff to fh at ofst. If fh doesn't implement io.WriterAt, the caller must hold the write lock.
+func writeAt(fh billy.File, buff []byte, ofst int64) (int, error) {
+	var n int
+	err := retryEINTR(func() error {
+		var err error
+		if wa, ok := fh.(io.WriterAt); ok {
+			n, err = wa.WriteAt(buff, ofst)
+			return err
+		}
+		if _, err := fh.Seek(ofst, io.SeekStart); err != nil {
+			return err
+		}
+		n, err = fh.Write(buff)
+		return err
+	})
+	return n, err
+}
+
+// chunked calls f for consecutive pieces of buff of at most max bytes, or once for all of buff if max is 0.
+// f returns the number of bytes transferred or a negative errno, and a short count ends the loop.
+// If f fails after earlier pieces succeeded, the number of bytes transferred so far is returned.
+func chunked(buff []byte, ofst int64, max int, f func(buff []byte, ofst int64) int) int {
+	if max <= 0 || len(buff) <= max {
+		return f(buff, ofst)
 	}
-	return n
+	var total int
+	for total < len(buff) {
+		end := total + max
+		if end > len(buff) {
+			end = len(buff)
+		}
+		n := f(buff[total:end], ofst+int64(total))
+		if n < 0 {
+			if total > 0 {
+				return total
+			}
+			return n
+		}
+		total += n
+		if total < end {
+			break
+		}
+	}
+	return total
 }
 
 // Flush flushes cached file data.
+// It's called for every close() of a file descriptor, which can be more than once if it was dup'ed,
+// so applications get to see sync errors on each of them. The error of a write that only partially succeeded is
+// reported by the first Flush, or by Release if there was none. The file stays open until Release.
 func (w *wrapper) Flush(path string, fd uint64) int {
-	return -fuse.ENOSYS
+	of, ok := w.getFileDescriptor(fd)
+	if !ok {
+		return -fuse.EINVAL
+	}
+	errc := 0
+	if _, ok := of.file.(syncer); ok {
+		errc = w.sync(of)
+	}
+	if err := of.takeLatchedError(); err != nil {
+		return convertError(err)
+	}
+	return errc
 }
 
 // Release closes an open file.
 func (w *wrapper) Release(path string, fd uint64) int {
 	w.fdMtx.Lock()
-	defer w.fdMtx.Unlock()
-	fh, ok := w.fileDescriptors[fd]
+	of, ok := w.fileDescriptors[fd]
 	if !ok {
+		w.fdMtx.Unlock()
+		if w.debugChecks {
+			w.violation("Release called for unknown file descriptor %d", fd)
+		}
 		return -fuse.EINVAL
 	}
 	delete(w.fileDescriptors, fd)
 	// It's fine if the write lock is still being held. The Close will soon unblock that.
 	delete(w.writeLocks, fd)
-	return convertError(fh.Close())
+	w.unreserveOpenLocked(of.path)
+	w.checkTableLocked()
+	w.fdMtx.Unlock()
+	if w.asyncRelease {
+		w.releases.Add(1)
+		go func() {
+			defer w.releases.Done()
+			if errc := w.release(of); errc != 0 {
+				w.logErrno("Release", of.path, errc)
+			}
+		}()
+		return 0
+	}
+	return w.release(of)
+}
+
+// release closes a file that was already removed from the file descriptor table.
+func (w *wrapper) release(of *openFile) int {
+	defer w.invalidateAttrs(of.path)
+	if of.readAhead != nil {
+		of.readAhead.invalidate()
+	}
+	if of.fsync != nil {
+		// Don't let waiting Fsync calls outlive the file.
+		of.fsync.flush()
+	}
+	if w.syncOnClose {
+		if sf, ok := of.file.(syncer); ok {
+			if err := sf.Sync(); err != nil {
+				w.closeAndLog("Release", of.path, of.file)
+				return convertError(err)
+			}
+		}
+	}
+	if err := of.file.Close(); err != nil {
+		return convertError(err)
+	}
+	if w.onClose != nil {
+		w.onClose(of.path, atomic.LoadInt64(&of.bytesWritten))
+	}
+	// Flush normally reports this, but the kernel doesn't always call it.
+	return convertError(of.takeLatchedError())
 }
 
 // Fsync synchronizes file contents.
 func (w *wrapper) Fsync(path string, datasync bool, fd uint64) int {
-	return -fuse.ENOSYS
+	of, ok := w.getFileDescriptor(fd)
+	if !ok {
+		return -fuse.EINVAL
+	}
+	if _, ok := of.file.(syncer); !ok {
+		return -fuse.ENOSYS
+	}
+	return w.sync(of)
+}
+
+// sync calls Sync on a file that implements syncer, coalesced with other calls if WithFsyncCoalesce is used.
+func (w *wrapper) sync(of *openFile) int {
+	if of.fsync != nil {
+		return convertError(of.fsync.sync())
+	}
+	return convertError(of.file.(syncer).Sync())
 }
 
 // Opendir opens a directory.
+// Like the kernel, it requires read permission, judged the same way as in Access.
 func (w *wrapper) Opendir(path string) (int, uint64) {
+	path, errc := cleanPath(path)
+	if errc != 0 {
+		return errc, 0
+	}
+	var st fuse.Stat_t
+	if errc := w.Getattr(path, &st, ^uint64(0)); errc != 0 {
+		return errc, 0
+	}
+	if st.Mode&fuse.S_IFMT != fuse.S_IFDIR {
+		return -fuse.ENOTDIR, 0
+	}
+	uid, gid, _ := fuse.Getcontext()
+	if errc := w.checkAccess(st.Mode, uid, gid, rOK); errc != 0 {
+		return errc, 0
+	}
 	w.fdMtx.Lock()
 	defer w.fdMtx.Unlock()
 	w.nextFd++
 	return 0, w.nextFd
 }
 
-func fileInfoToStat(fi os.FileInfo, out *fuse.Stat_t) {
+// FileInfoToStat converts fi to a fuse.Stat_t the way the FileSystem returned by New does.
+// Pass the same options as given to New to get the same results.
+// This is useful if you're embedding the FileSystem to override some methods.
+func FileInfoToStat(fi os.FileInfo, out *fuse.Stat_t, opts ...Option) {
+	newWrapper(nil, opts).fileInfoToStat(fi, out)
+}
+
+func (w *wrapper) fileInfoToStat(fi os.FileInfo, out *fuse.Stat_t) {
 	*out = fuse.Stat_t{
 		Size: fi.Size(),
 		Mtim: fuse.NewTimespec(fi.ModTime()),
-		Mode: uint32(fi.Mode()),
+		Mode: fileModeToFuse(fi.Mode()),
+		Uid:  w.uid,
+		Gid:  w.gid,
 	}
-	if fi.IsDir() {
-		out.Mode |= fuse.S_IFDIR
-	} else {
-		out.Mode |= fuse.S_IFREG
+	if w.noExec && out.Mode&fuse.S_IFMT != fuse.S_IFDIR {
+		// Directories keep their execute bits, or they couldn't be entered.
+		out.Mode &^= 0111
+	}
+	if w.defaultTimestamps {
+		def := w.defaultTime
+		if def.IsZero() {
+			def = w.now()
+		}
+		if !fi.ModTime().IsZero() {
+			// Billy has no access and change times. The modification time is the best guess for those.
+			def = fi.ModTime()
+		}
+		out.Mtim = fuse.NewTimespec(def)
+		out.Atim = out.Mtim
+		out.Ctim = out.Mtim
+	}
+}
+
+// fileModeToFuse converts an os.FileMode to the mode bits FUSE expects.
+// Go uses its own bits for the file type and setuid/setgid/sticky, so they can't be passed on as is.
+func fileModeToFuse(m os.FileMode) uint32 {
+	mode := uint32(m.Perm())
+	if m&os.ModeSetuid != 0 {
+		mode |= fuse.S_ISUID
+	}
+	if m&os.ModeSetgid != 0 {
+		mode |= fuse.S_ISGID
+	}
+	if m&os.ModeSticky != 0 {
+		mode |= fuse.S_ISVTX
+	}
+	switch {
+	case m.IsDir():
+		mode |= fuse.S_IFDIR
+	case m&os.ModeSymlink != 0:
+		mode |= fuse.S_IFLNK
+	case m&os.ModeNamedPipe != 0:
+		mode |= fuse.S_IFIFO
+	case m&os.ModeSocket != 0:
+		mode |= fuse.S_IFSOCK
+	case m&os.ModeCharDevice != 0:
+		mode |= fuse.S_IFCHR
+	case m&os.ModeDevice != 0:
+		mode |= fuse.S_IFBLK
+	default:
+		mode |= fuse.S_IFREG
+	}
+	return mode
+}
+
+// fileModeFromFuse converts mode bits from FUSE to an os.FileMode, keeping only the permissions and
+// setuid/setgid/sticky. The file type bits the kernel might include mean something else to Go.
+func fileModeFromFuse(mode uint32) os.FileMode {
+	m := os.FileMode(mode) & os.ModePerm
+	if mode&fuse.S_ISUID != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&fuse.S_ISGID != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&fuse.S_ISVTX != 0 {
+		m |= os.ModeSticky
 	}
+	return m
 }
 
 // Readdir reads a directory.
@@ -292,26 +1723,89 @@ func (w *wrapper) Readdir(path string,
 	fill func(name string, stat *fuse.Stat_t, ofst int64) bool,
 	ofst int64,
 	fh uint64) int {
-	if dfs, ok := w.underlying.(billy.Dir); ok {
-		entries, err := dfs.ReadDir(path)
-		if err != nil {
-			return convertError(err)
+	path, errc := cleanPath(path)
+	if errc != 0 {
+		return errc
+	}
+	dfs, ok := w.backend().(billy.Dir)
+	if !ok {
+		return -fuse.ENOSYS
+	}
+	if w.readdirBatchSize > 0 {
+		return w.readdirBatch(dfs, path, fill, ofst)
+	}
+	entries, errc := w.readDirSorted(dfs, path)
+	if errc != 0 {
+		return errc
+	}
+	for _, e := range entries {
+		if w.hidden(path, e) {
+			continue
 		}
-		// TODO(sjors): This sort.Strings is a workaround for an issue
-		// reproducible in at least two implementations of FUSE on macOS.
-		// Perhaps there is an issue in macFUSE somewhere. See e.g.
-		// https://github.com/billziss-gh/cgofuse/issues/57
-		sort.Slice(entries, func(i, j int) bool {
-			return entries[i].Name() < entries[j].Name()
-		})
-		for _, e := range entries {
-			st := new(fuse.Stat_t)
-			fileInfoToStat(e, st)
-			fill(e.Name(), st, 0)
+		fill(e.Name(), w.direntStat(path, e), 0)
+	}
+	return 0
+}
+
+// readDirSorted reads all entries of a directory, sorted by name.
+func (w *wrapper) readDirSorted(dfs billy.Dir, path string) ([]os.FileInfo, int) {
+	var entries []os.FileInfo
+	var err error
+	if w.flatSep != "" {
+		if path != "/" {
+			return nil, -fuse.ENOENT
 		}
+		entries, err = w.readFlatDir(dfs)
+	} else {
+		err = w.onReadReplica(func(fs billy.Basic) error {
+			var err error
+			entries, err = readDirFS(fs, path)
+			return err
+		})
+	}
+	if errc := w.readDirError(path, entries, err); errc != 0 {
+		return nil, errc
+	}
+	entries = w.addVirtualEntries(path, entries)
+	// TODO(sjors): This sort.Strings is a workaround for an issue
+	// reproducible in at least two implementations of FUSE on macOS.
+	// Perhaps there is an issue in macFUSE somewhere. See e.g.
+	// https://github.com/billziss-gh/cgofuse/issues/57
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, 0
+}
+
+// readDirError decides whether an error from listing a directory fails Readdir. Some backends return the entries
+// they could read along with an error, and we list those unless WithStrictReaddir is used.
+func (w *wrapper) readDirError(path string, entries []os.FileInfo, err error) int {
+	if err == nil {
 		return 0
 	}
-	return -fuse.ENOSYS
+	errc := convertError(err)
+	if len(entries) == 0 || w.strictReaddir {
+		return errc
+	}
+	w.logErrno("Readdir (partial listing)", path, errc)
+	return 0
+}
+
+// hidden returns whether e, an entry of dir, is left out of listings as a sidecar file or by the WithReaddirFilter
+// filter.
+func (w *wrapper) hidden(dir string, e os.FileInfo) bool {
+	if w.isSidecar(dir, e.Name()) {
+		return true
+	}
+	return w.readdirFilter != nil && !w.readdirFilter(e.Name(), e)
+}
+
+// direntStat converts a directory entry of path for Readdir.
+func (w *wrapper) direntStat(path string, e os.FileInfo) *fuse.Stat_t {
+	st := new(fuse.Stat_t)
+	w.fileInfoToStat(e, st)
+	w.setSymlinkSize(w.flatToBackend(gopath.Join(path, e.Name())), st)
+	return st
 }
 
 // Releasedir closes an open directory.
@@ -319,35 +1813,123 @@ func (w *wrapper) Releasedir(path string, fd uint64) int {
 	return 0
 }
 
+// DirSyncer can be implemented by a billy filesystem that can persist changes to a directory, like a journal.
+type DirSyncer interface {
+	SyncDir(path string, datasync bool) error
+}
+
 // Fsyncdir synchronizes directory contents.
+// Backends that don't implement DirSyncer have nothing to sync, so we report success.
 func (w *wrapper) Fsyncdir(path string, datasync bool, fd uint64) int {
-	return -fuse.ENOSYS
+	path, errc := cleanPath(path)
+	if errc != 0 {
+		return errc
+	}
+	if ds, ok := w.backend().(DirSyncer); ok {
+		return convertError(ds.SyncDir(w.flatToBackend(path), datasync))
+	}
+	return 0
 }
 
 // Setxattr sets extended attributes.
 func (w *wrapper) Setxattr(path string, name string, value []byte, flags int) int {
+	path, errc := cleanPath(path)
+	if errc != 0 {
+		return errc
+	}
+	if w.sidecars != nil {
+		if isProbedXattr(name) {
+			// Getxattr never looks these up, so storing them would make them disappear.
+			return -fuse.ENOTSUP
+		}
+		return w.setxattr(path, name, value, flags)
+	}
 	return -fuse.ENOSYS
 }
 
 // Getxattr gets extended attributes.
 func (w *wrapper) Getxattr(path string, name string) (int, []byte) {
+	if isProbedXattr(name) {
+		return -fuse.ENOATTR, nil
+	}
+	path, errc := cleanPath(path)
+	if errc != 0 {
+		return errc, nil
+	}
+	if w.sidecars != nil {
+		return w.getxattr(path, name)
+	}
 	return -fuse.ENOSYS, nil
 }
 
+// isProbedXattr returns whether the kernel asks for this attribute on (nearly) every access.
+// Answering those with ENOSYS can disable xattrs altogether or flood the audit log on SELinux hosts,
+// so we say the file just doesn't have them.
+func isProbedXattr(name string) bool {
+	return name == "security.selinux" || strings.HasPrefix(name, "system.posix_acl_")
+}
+
 // Removexattr removes extended attributes.
 func (w *wrapper) Removexattr(path string, name string) int {
+	path, errc := cleanPath(path)
+	if errc != 0 {
+		return errc
+	}
+	if w.sidecars != nil {
+		return w.removexattr(path, name)
+	}
 	return -fuse.ENOSYS
 }
 
 // Listxattr lists extended attributes.
 func (w *wrapper) Listxattr(path string, fill func(name string) bool) int {
+	path, errc := cleanPath(path)
+	if errc != 0 {
+		return errc
+	}
+	if w.sidecars != nil {
+		return w.listxattr(path, fill)
+	}
 	return -fuse.ENOSYS
 }
 
+// maxEINTRRetries is how many times an interrupted backend call is attempted before giving up.
+const maxEINTRRetries = 3
+
+// retryEINTR calls f again if it fails with EINTR, like the Go runtime does for syscalls.
+// Only use it for calls that are safe to repeat.
+func retryEINTR(f func() error) error {
+	var err error
+	for i := 0; i < maxEINTRRetries; i++ {
+		err = f()
+		if !errors.Is(err, syscall.EINTR) {
+			break
+		}
+	}
+	return err
+}
+
+// errnos maps errnos from the syscall package to their FUSE equivalents, which have different values on some platforms.
+var errnos = map[syscall.Errno]int{
+	syscall.ENOENT:    fuse.ENOENT,
+	syscall.ENOTDIR:   fuse.ENOTDIR,
+	syscall.ENOSPC:    fuse.ENOSPC,
+	syscall.ELOOP:     fuse.ELOOP,
+	syscall.EBUSY:     fuse.EBUSY,
+	syscall.ENOTEMPTY: fuse.ENOTEMPTY,
+	syscall.EXDEV:     fuse.EXDEV,
+}
+
 func convertError(err error) int {
 	if err == nil {
 		return 0
 	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		if errc, ok := errnos[errno]; ok {
+			return -errc
+		}
+	}
 	if os.IsExist(err) {
 		return -fuse.EEXIST
 	}
@@ -360,5 +1942,17 @@ func convertError(err error) int {
 	if errors.Is(err, os.ErrInvalid) || errors.Is(err, os.ErrClosed) {
 		return -fuse.EINVAL
 	}
+	if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, context.DeadlineExceeded) {
+		return -fuse.ETIMEDOUT
+	}
+	if errors.Is(err, billy.ErrReadOnly) {
+		return -fuse.EROFS
+	}
+	if errors.Is(err, billy.ErrNotSupported) {
+		return -fuse.ENOTSUP
+	}
+	if errors.Is(err, billy.ErrCrossedBoundary) {
+		return -fuse.EACCES
+	}
 	return -fuse.EIO
 }
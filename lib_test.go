@@ -0,0 +1,635 @@
+package billycgofuse
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	gopath "path"
+	"reflect"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/billziss-gh/cgofuse/fuse"
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+)
+
+// newTestFS returns a FileSystem on top of a new in-memory filesystem, which is returned too for setting up and
+// inspecting its contents directly.
+func newTestFS(t testing.TB, opts ...Option) (FileSystem, billy.Filesystem) {
+	t.Helper()
+	bfs := memfs.New()
+	return New(bfs, opts...), bfs
+}
+
+// writeFile creates a file on the backend directly, along with its parent directories.
+func writeFile(t testing.TB, bfs billy.Filesystem, path string, data string) {
+	t.Helper()
+	if err := util.WriteFile(bfs, path, []byte(data), 0644); err != nil {
+		t.Fatalf("WriteFile(%q): %v", path, err)
+	}
+}
+
+// mkdirAll creates a directory on the backend directly.
+func mkdirAll(t testing.TB, bfs billy.Filesystem, path string) {
+	t.Helper()
+	if err := bfs.MkdirAll(path, 0755); err != nil {
+		t.Fatalf("MkdirAll(%q): %v", path, err)
+	}
+}
+
+// open opens path through fs and returns the file descriptor.
+func open(t testing.TB, fs FileSystem, path string, flags int) uint64 {
+	t.Helper()
+	errc, fd := fs.Open(path, flags)
+	if errc != 0 {
+		t.Fatalf("Open(%q) = %d", path, errc)
+	}
+	return fd
+}
+
+func TestRenameOverDirectory(t *testing.T) {
+	fs, bfs := newTestFS(t)
+	writeFile(t, bfs, "/file", "hello")
+	mkdirAll(t, bfs, "/dir/sub")
+	writeFile(t, bfs, "/full/file", "hello")
+	mkdirAll(t, bfs, "/empty")
+	for _, tc := range []struct {
+		name    string
+		oldpath string
+		newpath string
+		want    int
+	}{
+		{"file over directory", "/file", "/empty", -fuse.EISDIR},
+		{"directory over non-empty directory", "/dir", "/full", -fuse.ENOTEMPTY},
+		{"directory into itself", "/dir", "/dir/sub/dir", -fuse.EINVAL},
+		{"directory into its own subdirectory", "/dir", "/dir/sub", -fuse.EINVAL},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := fs.Rename(tc.oldpath, tc.newpath); got != tc.want {
+				t.Errorf("Rename(%q, %q) = %d, want %d", tc.oldpath, tc.newpath, got, tc.want)
+			}
+		})
+	}
+	if errc := fs.Rename("/dir", "/empty"); errc != 0 {
+		t.Fatalf("Rename(%q, %q) = %d, want 0", "/dir", "/empty", errc)
+	}
+	if _, err := bfs.Stat("/empty/sub"); err != nil {
+		t.Errorf("directory wasn't moved over the empty directory: %v", err)
+	}
+}
+
+func TestOpenMissingFile(t *testing.T) {
+	fs, bfs := newTestFS(t)
+	// The kernel handles O_CREAT with Create, but Open must not create files even if it's passed along.
+	for _, flags := range []int{os.O_RDONLY, os.O_RDWR, os.O_RDWR | os.O_CREATE} {
+		if errc, _ := fs.Open("/missing", flags); errc != -fuse.ENOENT {
+			t.Errorf("Open(%q, %#o) = %d, want %d", "/missing", flags, errc, -fuse.ENOENT)
+		}
+	}
+	if _, err := bfs.Stat("/missing"); !os.IsNotExist(err) {
+		t.Errorf("Open created the missing file: Stat() = %v", err)
+	}
+}
+
+func TestZeroLengthReadWrite(t *testing.T) {
+	bfs, _ := newSlowFS(t, 0, 10)
+	fs := New(bfs)
+	fd := open(t, fs, "/file", os.O_RDWR)
+	defer fs.Release("/file", fd)
+	// Zero-length operations must not reach the backend, which would fail them.
+	atomic.StoreInt32(&bfs.failReads, 1)
+	for _, ofst := range []int64{0, 5, 100} {
+		if n := fs.Read("/file", nil, ofst, fd); n != 0 {
+			t.Errorf("Read(nil, %d) = %d, want 0", ofst, n)
+		}
+		if n := fs.Read("/file", []byte{}, ofst, fd); n != 0 {
+			t.Errorf("Read([]byte{}, %d) = %d, want 0", ofst, n)
+		}
+		if n := fs.Write("/file", nil, ofst, fd); n != 0 {
+			t.Errorf("Write(nil, %d) = %d, want 0", ofst, n)
+		}
+	}
+	if reads := atomic.LoadInt64(&bfs.reads); reads != 0 {
+		t.Errorf("backend got %d reads, want 0", reads)
+	}
+	if fi, err := bfs.Stat("/file"); err != nil || fi.Size() != 10 {
+		t.Errorf("Stat() = %v, %v; want the size to stay 10", fi, err)
+	}
+}
+
+// parentCheckFS fails creating files in directories that don't exist with err, unlike memfs, which creates the
+// parents.
+type parentCheckFS struct {
+	billy.Filesystem
+	err error
+}
+
+func (fs parentCheckFS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	if flag&os.O_CREATE != 0 {
+		if _, err := fs.Stat(gopath.Dir(filename)); os.IsNotExist(err) {
+			return nil, fs.err
+		}
+	}
+	return fs.Filesystem.OpenFile(filename, flag, perm)
+}
+
+func TestCreateInMissingDirectory(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  error
+	}{
+		{"ENOENT", &os.PathError{Op: "open", Path: "/missing/file", Err: syscall.ENOENT}},
+		{"unrecognized error", errors.New("parent doesn't exist")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := New(parentCheckFS{memfs.New(), tc.err})
+			if errc, _ := fs.Create("/missing/file", os.O_WRONLY, 0644); errc != -fuse.ENOENT {
+				t.Errorf("Create(%q) = %d, want %d", "/missing/file", errc, -fuse.ENOENT)
+			}
+		})
+	}
+}
+
+func TestWriteAfterRename(t *testing.T) {
+	fs, bfs := newTestFS(t)
+	mkdirAll(t, bfs, "/dir")
+	errc, fd := fs.Create("/dir/a", os.O_WRONLY, 0644)
+	if errc != 0 {
+		t.Fatalf("Create() = %d", errc)
+	}
+	if n := fs.Write("/dir/a", []byte("hello"), 0, fd); n != 5 {
+		t.Fatalf("Write() = %d, want 5", n)
+	}
+	if errc := fs.Rename("/dir/a", "/dir/b"); errc != 0 {
+		t.Fatalf("Rename(%q, %q) = %d", "/dir/a", "/dir/b", errc)
+	}
+	if errc := fs.Rename("/dir", "/moved"); errc != 0 {
+		t.Fatalf("Rename(%q, %q) = %d", "/dir", "/moved", errc)
+	}
+	if h := fs.OpenHandles(); len(h) != 1 || h[0].Path != "/moved/b" {
+		t.Errorf("OpenHandles() = %+v, want the file at /moved/b", h)
+	}
+	if n := fs.Write("/moved/b", []byte(" world"), 5, fd); n != 6 {
+		t.Fatalf("Write() after Rename = %d, want 6", n)
+	}
+	// A Truncate by path reuses the open file descriptor, which must be found under its new name.
+	if errc := fs.Truncate("/moved/b", 11, ^uint64(0)); errc != 0 {
+		t.Fatalf("Truncate() = %d", errc)
+	}
+	if errc := fs.Release("/moved/b", fd); errc != 0 {
+		t.Fatalf("Release() = %d", errc)
+	}
+	data, err := util.ReadFile(bfs, "/moved/b")
+	if err != nil || string(data) != "hello world" {
+		t.Errorf("ReadFile() = %q, %v; want %q", data, err, "hello world")
+	}
+	if _, err := bfs.Stat("/dir"); !os.IsNotExist(err) {
+		t.Errorf("Stat(%q) = %v, want it gone", "/dir", err)
+	}
+}
+
+func TestSymlinkLoop(t *testing.T) {
+	fs, bfs := newTestFS(t)
+	writeFile(t, bfs, "/file", "hello")
+	for _, l := range []struct{ target, link string }{
+		{"/self", "/self"},
+		{"/b", "/a"},
+		{"a", "/b"},
+		{"/file", "/link0"},
+	} {
+		if errc := fs.Symlink(l.target, l.link); errc != 0 {
+			t.Fatalf("Symlink(%q, %q) = %d", l.target, l.link, errc)
+		}
+	}
+	// A chain exactly as long as the kernel allows still resolves.
+	for i := 1; i < maxSymlinks; i++ {
+		target, link := fmt.Sprintf("/link%d", i-1), fmt.Sprintf("/link%d", i)
+		if errc := fs.Symlink(target, link); errc != 0 {
+			t.Fatalf("Symlink(%q, %q) = %d", target, link, errc)
+		}
+	}
+	for _, tc := range []struct {
+		path string
+		want int
+	}{
+		{"/self", -fuse.ELOOP},
+		{"/a", -fuse.ELOOP},
+		{"/b", -fuse.ELOOP},
+		{fmt.Sprintf("/link%d", maxSymlinks-1), 0},
+	} {
+		var st fuse.Stat_t
+		if errc := fs.Getattr(tc.path, &st, ^uint64(0)); errc != tc.want {
+			t.Errorf("Getattr(%q) = %d, want %d", tc.path, errc, tc.want)
+		} else if errc == 0 && (st.Mode&fuse.S_IFMT != fuse.S_IFREG || st.Size != 5) {
+			t.Errorf("Getattr(%q) = %+v, want the attributes of /file", tc.path, st)
+		}
+	}
+}
+
+// noGrowFS has files whose Truncate ignores growing the file, like some backends do.
+type noGrowFS struct {
+	billy.Filesystem
+}
+
+func (fs noGrowFS) Open(filename string) (billy.File, error) {
+	return fs.OpenFile(filename, os.O_RDONLY, 0)
+}
+
+func (fs noGrowFS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	f, err := fs.Filesystem.OpenFile(filename, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return noGrowFile{f, fs.Filesystem}, nil
+}
+
+type noGrowFile struct {
+	billy.File
+	fs billy.Filesystem
+}
+
+func (f noGrowFile) Truncate(size int64) error {
+	fi, err := f.fs.Stat(f.Name())
+	if err != nil {
+		return err
+	}
+	if size > fi.Size() {
+		return nil
+	}
+	return f.File.Truncate(size)
+}
+
+func TestTruncateGrow(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// open is the flags to open the file with before truncating it, if any.
+		open  int
+		useFd bool
+	}{
+		{"by file descriptor", os.O_RDWR, true},
+		{"by path with the file open", os.O_WRONLY, false},
+		{"by path", -1, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			bfs := memfs.New()
+			writeFile(t, bfs, "/file", "abc")
+			fs := New(noGrowFS{bfs})
+			fd := ^uint64(0)
+			if tc.open != -1 {
+				ofd := open(t, fs, "/file", tc.open)
+				defer fs.Release("/file", ofd)
+				if tc.useFd {
+					fd = ofd
+				}
+			}
+			if errc := fs.Truncate("/file", 10, fd); errc != 0 {
+				t.Fatalf("Truncate() = %d", errc)
+			}
+			data, err := util.ReadFile(bfs, "/file")
+			if want := "abc\x00\x00\x00\x00\x00\x00\x00"; err != nil || string(data) != want {
+				t.Errorf("ReadFile() = %q, %v; want %q", data, err, want)
+			}
+		})
+	}
+}
+
+func TestSymlinkOverExistingPath(t *testing.T) {
+	fs, bfs := newTestFS(t)
+	writeFile(t, bfs, "/file", "hello")
+	mkdirAll(t, bfs, "/dir")
+	if errc := fs.Symlink("/file", "/link"); errc != 0 {
+		t.Fatalf("Symlink() = %d", errc)
+	}
+	if errc := fs.Symlink("/missing", "/dangling"); errc != 0 {
+		t.Fatalf("Symlink() = %d", errc)
+	}
+	for _, path := range []string{"/file", "/dir", "/link", "/dangling"} {
+		if errc := fs.Symlink("/elsewhere", path); errc != -fuse.EEXIST {
+			t.Errorf("Symlink(%q) = %d, want %d", path, errc, -fuse.EEXIST)
+		}
+	}
+	if data, err := util.ReadFile(bfs, "/file"); err != nil || string(data) != "hello" {
+		t.Errorf("ReadFile() = %q, %v; want the file untouched", data, err)
+	}
+}
+
+func TestGetattrDanglingSymlink(t *testing.T) {
+	fs, _ := newTestFS(t)
+	if errc := fs.Symlink("/missing", "/dangling"); errc != 0 {
+		t.Fatalf("Symlink() = %d", errc)
+	}
+	var st fuse.Stat_t
+	if errc := fs.Getattr("/dangling", &st, ^uint64(0)); errc != 0 {
+		t.Fatalf("Getattr() = %d", errc)
+	}
+	if st.Mode&fuse.S_IFMT != fuse.S_IFLNK {
+		t.Errorf("Getattr() reported mode %#o, want a symlink", st.Mode)
+	}
+	if st.Size != int64(len("/missing")) {
+		t.Errorf("Getattr() reported size %d, want the length of the target", st.Size)
+	}
+}
+
+// readOnlyCapFS reports that it can't be written to.
+type readOnlyCapFS struct {
+	billy.Filesystem
+}
+
+func (readOnlyCapFS) Capabilities() billy.Capability {
+	return billy.ReadCapability | billy.SeekCapability
+}
+
+func TestOpenFlagsValidation(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		create   bool
+		flags    int
+		readOnly bool
+		want     int
+	}{
+		{"read", false, fuse.O_RDONLY, false, 0},
+		{"write", false, fuse.O_WRONLY, false, 0},
+		{"read write append", false, fuse.O_RDWR | fuse.O_APPEND, false, 0},
+		{"read truncate", false, fuse.O_RDONLY | fuse.O_TRUNC, false, -fuse.EINVAL},
+		{"invalid access mode", false, fuse.O_WRONLY | fuse.O_RDWR, false, -fuse.EINVAL},
+		{"read on read-only backend", false, fuse.O_RDONLY, true, 0},
+		{"write on read-only backend", false, fuse.O_WRONLY, true, -fuse.EROFS},
+		{"append on read-only backend", false, fuse.O_RDWR | fuse.O_APPEND, true, -fuse.EROFS},
+		{"create", true, fuse.O_WRONLY, false, 0},
+		{"create read-only", true, fuse.O_RDONLY, false, 0},
+		{"create read truncate", true, fuse.O_RDONLY | fuse.O_TRUNC, false, -fuse.EINVAL},
+		{"create on read-only backend", true, fuse.O_RDONLY, true, -fuse.EROFS},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var bfs billy.Filesystem = memfs.New()
+			writeFile(t, bfs, "/file", "hello")
+			if tc.readOnly {
+				bfs = readOnlyCapFS{bfs}
+			}
+			fs := New(bfs, WithOpenFlagsValidation())
+			var errc int
+			var fd uint64
+			if tc.create {
+				errc, fd = fs.Create("/new", tc.flags, 0644)
+			} else {
+				errc, fd = fs.Open("/file", tc.flags)
+			}
+			if errc == 0 {
+				fs.Release("/file", fd)
+			}
+			if errc != tc.want {
+				t.Errorf("flags %#o: got %d, want %d", tc.flags, errc, tc.want)
+			}
+		})
+	}
+}
+
+// noRenameFS fails every Rename.
+type noRenameFS struct {
+	billy.Filesystem
+}
+
+func (noRenameFS) Rename(oldpath, newpath string) error {
+	return errors.New("unexpected Rename")
+}
+
+func TestRenameOntoItself(t *testing.T) {
+	bfs := memfs.New()
+	writeFile(t, bfs, "/dir/file", "hello")
+	fs := New(noRenameFS{bfs})
+	for _, tc := range []struct{ oldpath, newpath string }{
+		{"/dir/file", "/dir/file"},
+		{"/dir", "/dir"},
+		{"/dir/file", "/dir//file"},
+	} {
+		if errc := fs.Rename(tc.oldpath, tc.newpath); errc != 0 {
+			t.Errorf("Rename(%q, %q) = %d, want 0", tc.oldpath, tc.newpath, errc)
+		}
+	}
+	if data, err := util.ReadFile(bfs, "/dir/file"); err != nil || string(data) != "hello" {
+		t.Errorf("ReadFile() = %q, %v; want the file untouched", data, err)
+	}
+}
+
+func TestRemoveWrongType(t *testing.T) {
+	fs, bfs := newTestFS(t)
+	writeFile(t, bfs, "/file", "hello")
+	mkdirAll(t, bfs, "/dir")
+	if errc := fs.Rmdir("/file"); errc != -fuse.ENOTDIR {
+		t.Errorf("Rmdir(%q) = %d, want %d", "/file", errc, -fuse.ENOTDIR)
+	}
+	if errc := fs.Unlink("/dir"); errc != -fuse.EISDIR {
+		t.Errorf("Unlink(%q) = %d, want %d", "/dir", errc, -fuse.EISDIR)
+	}
+	for _, path := range []string{"/file", "/dir"} {
+		if _, err := bfs.Stat(path); err != nil {
+			t.Errorf("%s was removed: %v", path, err)
+		}
+	}
+	if errc := fs.Rmdir("/dir"); errc != 0 {
+		t.Errorf("Rmdir(%q) = %d, want 0", "/dir", errc)
+	}
+	if errc := fs.Unlink("/file"); errc != 0 {
+		t.Errorf("Unlink(%q) = %d, want 0", "/file", errc)
+	}
+}
+
+// shortWriteFS has files that only write the first half of every write, and then fail with ENOSPC.
+type shortWriteFS struct {
+	billy.Filesystem
+}
+
+func (fs shortWriteFS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	f, err := fs.Filesystem.OpenFile(filename, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return shortWriteFile{f}, nil
+}
+
+type shortWriteFile struct {
+	billy.File
+}
+
+func (f shortWriteFile) Write(p []byte) (int, error) {
+	n, err := f.File.Write(p[:len(p)/2])
+	if err != nil {
+		return n, err
+	}
+	return n, syscall.ENOSPC
+}
+
+func TestLatchedWriteError(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// flushes is the number of times Flush is called before Release.
+		flushes int
+		// want are the results of the Flushes followed by Release.
+		want []int
+	}{
+		{"reported by the first Flush", 2, []int{-fuse.ENOSPC, 0, 0}},
+		{"reported by Release without Flush", 0, []int{-fuse.ENOSPC}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			bfs := memfs.New()
+			writeFile(t, bfs, "/file", "")
+			fs := New(shortWriteFS{bfs})
+			fd := open(t, fs, "/file", os.O_WRONLY)
+			if n := fs.Write("/file", []byte("0123456789"), 0, fd); n != 5 {
+				t.Fatalf("Write() = %d, want the 5 bytes that were written", n)
+			}
+			var got []int
+			for i := 0; i < tc.flushes; i++ {
+				got = append(got, fs.Flush("/file", fd))
+			}
+			got = append(got, fs.Release("/file", fd))
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Flush and Release returned %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// timeFileInfo overrides the modification time of a FileInfo.
+type timeFileInfo struct {
+	os.FileInfo
+	mtime time.Time
+}
+
+func (fi timeFileInfo) ModTime() time.Time {
+	return fi.mtime
+}
+
+func TestDefaultTimestamps(t *testing.T) {
+	bfs := memfs.New()
+	writeFile(t, bfs, "/file", "hello")
+	fi, err := bfs.Stat("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	def := time.Unix(1600000000, 0)
+	mtime := time.Unix(1700000000, 0)
+	for _, tc := range []struct {
+		name  string
+		mtime time.Time
+		want  time.Time
+	}{
+		{"with modification time", mtime, mtime},
+		{"without modification time", time.Time{}, def},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var st fuse.Stat_t
+			FileInfoToStat(timeFileInfo{fi, tc.mtime}, &st, WithDefaultTimestamps(def))
+			want := fuse.NewTimespec(tc.want)
+			if st.Mtim != want || st.Atim != want || st.Ctim != want {
+				t.Errorf("got mtime %v, atime %v, ctime %v; want all %v", st.Mtim, st.Atim, st.Ctim, want)
+			}
+		})
+	}
+}
+
+// rootlessFS has no entry for the root, like object stores.
+type rootlessFS struct {
+	billy.Filesystem
+}
+
+func (fs rootlessFS) Stat(filename string) (os.FileInfo, error) {
+	if filename == "/" {
+		return nil, &os.PathError{Op: "stat", Path: filename, Err: os.ErrNotExist}
+	}
+	return fs.Filesystem.Stat(filename)
+}
+
+func (fs rootlessFS) Lstat(filename string) (os.FileInfo, error) {
+	if filename == "/" {
+		return nil, &os.PathError{Op: "lstat", Path: filename, Err: os.ErrNotExist}
+	}
+	return fs.Filesystem.Lstat(filename)
+}
+
+func TestRootlessBackend(t *testing.T) {
+	fs := New(rootlessFS{memfs.New()}, WithRootMode(0700))
+	if err := fs.Ping(); err != nil {
+		t.Errorf("Ping() = %v, want nil", err)
+	}
+	var st fuse.Stat_t
+	if errc := fs.Getattr("/", &st, ^uint64(0)); errc != 0 {
+		t.Fatalf("Getattr(%q) = %d", "/", errc)
+	}
+	if want := uint32(fuse.S_IFDIR | 0700); st.Mode != want {
+		t.Errorf("Getattr(%q) reported mode %#o, want %#o", "/", st.Mode, want)
+	}
+}
+
+// mknodFS records the paths passed to Mknod.
+type mknodFS struct {
+	billy.Filesystem
+	paths []string
+}
+
+func (fs *mknodFS) Mknod(path string, mode uint32, dev uint64) error {
+	fs.paths = append(fs.paths, path)
+	return nil
+}
+
+func TestMknodFlatLayout(t *testing.T) {
+	bfs := &mknodFS{Filesystem: memfs.New()}
+	fs := New(bfs, WithFlatLayout("|"))
+	if errc := fs.Mknod("/dir|fifo", fuse.S_IFIFO|0644, 0); errc != 0 {
+		t.Fatalf("Mknod() = %d", errc)
+	}
+	if errc := fs.Mknod("/dir|file", fuse.S_IFREG|0644, 0); errc != 0 {
+		t.Fatalf("Mknod() = %d", errc)
+	}
+	if want := []string{"/dir/fifo"}; !reflect.DeepEqual(bfs.paths, want) {
+		t.Errorf("backend got Mknod of %q, want %q", bfs.paths, want)
+	}
+	if _, err := bfs.Stat("/dir/file"); err != nil {
+		t.Errorf("regular file wasn't created at its backend path: %v", err)
+	}
+}
+
+func TestFlatLayoutPaths(t *testing.T) {
+	fs, bfs := newTestFS(t, WithFlatLayout("%"))
+	errc, fd := fs.Create("/a%b", fuse.O_RDWR, 0644)
+	if errc != 0 {
+		t.Fatalf("Create() = %d", errc)
+	}
+	fs.Release("/a%b", fd)
+	var st fuse.Stat_t
+	if errc := fs.Getattr("/a%b", &st, ^uint64(0)); errc != 0 {
+		t.Errorf("Getattr() after Create = %d", errc)
+	}
+	if _, err := bfs.Stat("/a/b"); err != nil {
+		t.Errorf("Create didn't create the file at its backend path: %v", err)
+	}
+
+	writeFile(t, bfs, "/x/y", "hello")
+	var names []string
+	fs.Readdir("/", func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		names = append(names, name)
+		return true
+	}, 0, ^uint64(0))
+	if !reflect.DeepEqual(names, []string{"a%b", "x%y"}) {
+		t.Fatalf("Readdir() listed %q", names)
+	}
+	if errc := fs.Truncate("/x%y", 2, ^uint64(0)); errc != 0 {
+		t.Errorf("Truncate() = %d", errc)
+	}
+	if errc := fs.Rename("/x%y", "/x%z"); errc != 0 {
+		t.Fatalf("Rename() = %d", errc)
+	}
+	if errc := fs.Getattr("/x%z", &st, ^uint64(0)); errc != 0 {
+		t.Fatalf("Getattr() after Rename = %d", errc)
+	}
+	if st.Size != 2 {
+		t.Errorf("size after Truncate = %d, want 2", st.Size)
+	}
+	if _, err := bfs.Stat("/x/y"); !os.IsNotExist(err) {
+		t.Errorf("old backend path still exists after Rename: %v", err)
+	}
+}
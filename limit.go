@@ -0,0 +1,29 @@
+package billycgofuse
+
+import (
+	"os"
+	"time"
+)
+
+// acquire waits for a free slot if WithConcurrencyLimit is used, and returns a function that frees it again.
+// If timeout is positive, it gives up after that long and returns os.ErrDeadlineExceeded.
+func (w *wrapper) acquire(timeout time.Duration) (func(), error) {
+	if w.concurrency == nil {
+		return func() {}, nil
+	}
+	release := func() {
+		<-w.concurrency
+	}
+	if timeout <= 0 {
+		w.concurrency <- struct{}{}
+		return release, nil
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case w.concurrency <- struct{}{}:
+		return release, nil
+	case <-t.C:
+		return nil, os.ErrDeadlineExceeded
+	}
+}
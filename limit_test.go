@@ -0,0 +1,67 @@
+package billycgofuse
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyLimit(t *testing.T) {
+	bfs, _ := newSlowFS(t, time.Millisecond, 64<<10)
+	// Read-ahead adds prefetches in the background, which count towards the limit too.
+	fs := New(bfs, WithConcurrencyLimit(2), WithReadAhead(4096))
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fd := open(t, fs, "/file", os.O_RDONLY)
+			defer fs.Release("/file", fd)
+			buff := make([]byte, 4096)
+			for ofst := int64(0); ofst < 64<<10; ofst += int64(len(buff)) {
+				if n := fs.Read("/file", buff, ofst, fd); n != len(buff) {
+					t.Errorf("Read(%d) = %d, want %d", ofst, n, len(buff))
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if max := atomic.LoadInt64(&bfs.maxInFlight); max > 2 {
+		t.Errorf("%d reads were in flight at once, want at most 2", max)
+	}
+}
+
+func BenchmarkConcurrencyLimit(b *testing.B) {
+	const readSize = 4096
+	for _, limit := range []int{0, 1, 4, 16} {
+		b.Run(fmt.Sprintf("limit=%d", limit), func(b *testing.B) {
+			bfs, _ := newSlowFS(b, time.Millisecond, 64<<10)
+			var opts []Option
+			if limit > 0 {
+				opts = append(opts, WithConcurrencyLimit(limit))
+			}
+			fs := New(bfs, opts...)
+			b.SetBytes(readSize)
+			b.SetParallelism(4)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				fd := open(b, fs, "/file", os.O_RDONLY)
+				defer fs.Release("/file", fd)
+				buff := make([]byte, readSize)
+				var ofst int64
+				for pb.Next() {
+					if n := fs.Read("/file", buff, ofst, fd); n != readSize {
+						b.Errorf("Read(%d) = %d, want %d", ofst, n, readSize)
+						return
+					}
+					ofst = (ofst + readSize) % (64 << 10)
+				}
+			})
+			b.ReportMetric(float64(atomic.LoadInt64(&bfs.maxInFlight)), "max-in-flight")
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package billycgofuse
+
+import "time"
+
+// livenessProbe periodically checks whether the backend is reachable, for WithLivenessProbe.
+type livenessProbe struct {
+	interval time.Duration
+	onDown   func(error)
+	onUp     func()
+	started  bool
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// run pings the backend every interval until stop is closed, and calls onDown and onUp when the result changes.
+// The backend is assumed to be up when the probe starts.
+func (p *livenessProbe) run(ping func() error) {
+	defer close(p.done)
+	t := time.NewTicker(p.interval)
+	defer t.Stop()
+	up := true
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-t.C:
+		}
+		err := ping()
+		switch {
+		case err != nil && up:
+			up = false
+			if p.onDown != nil {
+				p.onDown(err)
+			}
+		case err == nil && !up:
+			up = true
+			if p.onUp != nil {
+				p.onUp()
+			}
+		}
+	}
+}
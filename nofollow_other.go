@@ -0,0 +1,9 @@
+//go:build !windows
+// +build !windows
+
+package billycgofuse
+
+import "syscall"
+
+// oNofollow is O_NOFOLLOW, which the os package doesn't export.
+const oNofollow = syscall.O_NOFOLLOW
@@ -0,0 +1,7 @@
+//go:build windows
+// +build windows
+
+package billycgofuse
+
+// oNofollow is O_NOFOLLOW, which Windows doesn't have.
+const oNofollow = 0
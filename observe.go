@@ -0,0 +1,127 @@
+package billycgofuse
+
+import "github.com/billziss-gh/cgofuse/fuse"
+
+// record reports the result of an operation to WithAuditLog and, if it succeeded and changed something, to
+// WithEventEmitter.
+func (w *wrapper) record(op, path, newPath string, bytes int64, errc int) {
+	if w.auditor != nil {
+		w.audit(op, path, newPath, bytes, errc)
+	}
+	if w.emitter != nil && errc == 0 {
+		if eop, ok := eventOps[op]; ok {
+			e := Event{Op: eop, Path: path}
+			if eop == EventRename {
+				e.NewPath = newPath
+			}
+			w.emitter(e)
+		}
+	}
+}
+
+// observedWrapper is returned by New if WithAuditLog or WithEventEmitter is used. It reports the result of every
+// operation that modifies the filesystem, and of reads if asked to.
+type observedWrapper struct {
+	*wrapper
+}
+
+// Destroy waits for the pending audit entries to be handled.
+func (a observedWrapper) Destroy() {
+	a.wrapper.Destroy()
+	if a.auditor != nil {
+		a.auditor.start.Do(func() {
+			go a.auditor.run()
+		})
+		close(a.auditor.ch)
+		<-a.auditor.done
+	}
+}
+
+func (a observedWrapper) Mknod(path string, mode uint32, dev uint64) int {
+	errc := a.wrapper.Mknod(path, mode, dev)
+	a.record("Mknod", path, "", 0, errc)
+	return errc
+}
+
+func (a observedWrapper) Mkdir(path string, mode uint32) int {
+	errc := a.wrapper.Mkdir(path, mode)
+	a.record("Mkdir", path, "", 0, errc)
+	return errc
+}
+
+func (a observedWrapper) Unlink(path string) int {
+	errc := a.wrapper.Unlink(path)
+	a.record("Unlink", path, "", 0, errc)
+	return errc
+}
+
+func (a observedWrapper) Rmdir(path string) int {
+	errc := a.wrapper.Rmdir(path)
+	a.record("Rmdir", path, "", 0, errc)
+	return errc
+}
+
+func (a observedWrapper) Symlink(target, newpath string) int {
+	errc := a.wrapper.Symlink(target, newpath)
+	a.record("Symlink", newpath, target, 0, errc)
+	return errc
+}
+
+func (a observedWrapper) Rename(oldpath, newpath string) int {
+	errc := a.wrapper.Rename(oldpath, newpath)
+	a.record("Rename", oldpath, newpath, 0, errc)
+	return errc
+}
+
+func (a observedWrapper) Chmod(path string, mode uint32) int {
+	errc := a.wrapper.Chmod(path, mode)
+	a.record("Chmod", path, "", 0, errc)
+	return errc
+}
+
+func (a observedWrapper) Chown(path string, uid uint32, gid uint32) int {
+	errc := a.wrapper.Chown(path, uid, gid)
+	a.record("Chown", path, "", 0, errc)
+	return errc
+}
+
+func (a observedWrapper) Utimens(path string, tmsp []fuse.Timespec) int {
+	errc := a.wrapper.Utimens(path, tmsp)
+	a.record("Utimens", path, "", 0, errc)
+	return errc
+}
+
+func (a observedWrapper) Create(path string, flags int, mode uint32) (int, uint64) {
+	errc, fh := a.wrapper.Create(path, flags, mode)
+	a.record("Create", path, "", 0, errc)
+	return errc, fh
+}
+
+func (a observedWrapper) Truncate(path string, size int64, fd uint64) int {
+	errc := a.wrapper.Truncate(path, size, fd)
+	a.record("Truncate", path, "", size, errc)
+	return errc
+}
+
+func (a observedWrapper) Write(path string, buff []byte, ofst int64, fd uint64) int {
+	n := a.wrapper.Write(path, buff, ofst, fd)
+	a.recordTransfer("Write", path, n)
+	return n
+}
+
+func (a observedWrapper) Read(path string, buff []byte, ofst int64, fd uint64) int {
+	n := a.wrapper.Read(path, buff, ofst, fd)
+	if a.auditor != nil && a.auditReads {
+		a.recordTransfer("Read", path, n)
+	}
+	return n
+}
+
+// recordTransfer records a Read or Write, which return either a byte count or an errno.
+func (a observedWrapper) recordTransfer(op, path string, n int) {
+	if n < 0 {
+		a.record(op, path, "", 0, n)
+	} else {
+		a.record(op, path, "", int64(n), 0)
+	}
+}
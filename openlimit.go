@@ -0,0 +1,46 @@
+package billycgofuse
+
+// reserveOpen claims one of the WithMaxOpensPerPath slots of path, and returns false if they're all taken.
+// The slot goes to the file descriptor that gets created, and is freed by Release. If opening fails, the caller
+// frees it with unreserveOpen.
+func (w *wrapper) reserveOpen(path string) bool {
+	if w.maxOpensPerPath <= 0 {
+		return true
+	}
+	w.fdMtx.Lock()
+	defer w.fdMtx.Unlock()
+	if w.openCounts[path] >= w.maxOpensPerPath {
+		return false
+	}
+	w.openCounts[path]++
+	return true
+}
+
+func (w *wrapper) unreserveOpen(path string) {
+	if w.maxOpensPerPath <= 0 {
+		return
+	}
+	w.fdMtx.Lock()
+	defer w.fdMtx.Unlock()
+	w.unreserveOpenLocked(path)
+}
+
+// unreserveOpenLocked frees a slot of path. fdMtx must be held.
+func (w *wrapper) unreserveOpenLocked(path string) {
+	if w.maxOpensPerPath <= 0 {
+		return
+	}
+	w.openCounts[path]--
+	if w.openCounts[path] <= 0 {
+		delete(w.openCounts, path)
+	}
+}
+
+// moveOpenLocked moves a slot from oldpath to newpath after an open file was renamed. fdMtx must be held.
+func (w *wrapper) moveOpenLocked(oldpath, newpath string) {
+	if w.maxOpensPerPath <= 0 {
+		return
+	}
+	w.unreserveOpenLocked(oldpath)
+	w.openCounts[newpath]++
+}
@@ -0,0 +1,553 @@
+package billycgofuse
+
+import (
+	"log"
+	"os"
+	gopath "path"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// Option configures the filesystem returned by New.
+type Option func(w *wrapper)
+
+// WithLogger sets the logger used for diagnostic messages. It defaults to log.Default().
+func WithLogger(l *log.Logger) Option {
+	return func(w *wrapper) {
+		w.logger = l
+	}
+}
+
+// WithName sets a name that is included in log messages, so multiple mounts in one process can be told apart.
+func WithName(name string) Option {
+	return func(w *wrapper) {
+		w.name = name
+	}
+}
+
+// WithDebugChecks enables assertions on the internal state of the wrapper.
+// Violations are logged, and cause a panic if panicOnViolation is set.
+// This is meant for development and makes every call a bit slower.
+func WithDebugChecks(panicOnViolation bool) Option {
+	return func(w *wrapper) {
+		w.debugChecks = true
+		w.panicOnViolation = panicOnViolation
+	}
+}
+
+// WithSyncOnClose makes Release call Sync on files that support it before closing them.
+// If the Sync fails, that error is returned instead of the result of Close.
+func WithSyncOnClose() Option {
+	return func(w *wrapper) {
+		w.syncOnClose = true
+	}
+}
+
+// WithPerPathLocking serializes Write, Truncate, Chmod, Rename and Unlink calls on the same path.
+// This prevents writes through different file descriptors from interleaving at the backend,
+// at the cost of throughput.
+func WithPerPathLocking() Option {
+	return func(w *wrapper) {
+		w.pathLocks = newPathLocker()
+	}
+}
+
+// WithReadAhead makes sequential reads prefetch the next n bytes in the background.
+// This helps throughput on backends with a high latency per request. Prefetches are subject to the same read timeout,
+// retries and concurrency limit as other reads, and a read doesn't wait longer than the read timeout for a prefetch.
+func WithReadAhead(n int) Option {
+	return func(w *wrapper) {
+		w.readAheadSize = n
+	}
+}
+
+// WithDiscardWrites makes Write and Truncate report success without passing them to the backend.
+// Create still creates an (empty) file, because the kernel stats it right afterwards.
+// This is meant for measuring the overhead of the FUSE layer in benchmarks.
+func WithDiscardWrites() Option {
+	return func(w *wrapper) {
+		w.discardWrites = true
+	}
+}
+
+// WithCaseInsensitive makes Getattr and Open fall back to a case-insensitive search of the parent directory
+// when the exact path doesn't exist. This is useful for case-insensitive clients (like macOS and Windows)
+// on a case-sensitive backend. Resolved names are cached.
+func WithCaseInsensitive() Option {
+	return func(w *wrapper) {
+		w.caseResolver = newCaseResolver()
+	}
+}
+
+// WithFollowSymlinks sets whether Getattr follows symlinks. It does by default.
+// If follow is false, Getattr reports symlinks themselves (as S_IFLNK) on backends that implement billy.Symlink.
+func WithFollowSymlinks(follow bool) Option {
+	return func(w *wrapper) {
+		w.followSymlinks = follow
+	}
+}
+
+// WithStatfs sets the statistics Statfs reports for backends that don't implement StatFSer.
+func WithStatfs(st StatFS) Option {
+	return func(w *wrapper) {
+		w.defaultStatFS = st
+	}
+}
+
+// WithMaxReadSize limits the number of bytes read from the backend in a single call.
+// Larger reads are split into multiple backend calls.
+func WithMaxReadSize(n int) Option {
+	return func(w *wrapper) {
+		w.maxReadSize = n
+	}
+}
+
+// WithMaxWriteSize limits the number of bytes written to the backend in a single call.
+// Larger writes are split into multiple backend calls. If one of them fails, the bytes written before it are reported.
+func WithMaxWriteSize(n int) Option {
+	return func(w *wrapper) {
+		w.maxWriteSize = n
+	}
+}
+
+// WithFsyncCoalesce batches Fsync calls on a file that arrive within window into a single Sync on the backend.
+// Everyone in a batch gets the same result. Pending batches are flushed when the file is released.
+// Fsync is only supported for files that have a Sync method, like *os.File.
+func WithFsyncCoalesce(window time.Duration) Option {
+	return func(w *wrapper) {
+		w.fsyncWindow = window
+	}
+}
+
+// WithOpenTimeout makes Open and Create fail with ETIMEDOUT if the backend doesn't open the file within d.
+// A file that gets opened after the timeout is closed again.
+// The backend call keeps running in its own goroutine, so a backend that never returns leaks a goroutine per attempt.
+func WithOpenTimeout(d time.Duration) Option {
+	return func(w *wrapper) {
+		w.openTimeout = d
+	}
+}
+
+// WithAttrCache caches the results of Getattr for ttl.
+// Modifications through the mount invalidate the cache, but changes made to the backend by others can take up to ttl to show up.
+func WithAttrCache(ttl time.Duration) Option {
+	return func(w *wrapper) {
+		w.attrCache = newAttrCache(ttl)
+	}
+}
+
+// WithOwner sets the owner and group reported for all files. It defaults to root.
+// Access uses them to decide whether the owner, group or other permission bits apply to the caller.
+func WithOwner(uid, gid uint32) Option {
+	return func(w *wrapper) {
+		w.uid = uid
+		w.gid = gid
+	}
+}
+
+// WithClock sets the function used to get the current time, for example for Utimens without explicit times
+// and for expiring caches. It defaults to time.Now and is mostly useful for tests.
+func WithClock(now func() time.Time) Option {
+	return func(w *wrapper) {
+		w.now = now
+	}
+}
+
+// WithFlatLayout presents every file of the backend directly in the root of the mount, with the slashes in their
+// path replaced by sep. This is useful for key-value backends where paths are opaque keys.
+// Directories on the backend don't show up in the listing.
+func WithFlatLayout(sep string) Option {
+	return func(w *wrapper) {
+		w.flatSep = sep
+	}
+}
+
+// WithReaddirBatchSize makes Readdir return at most n entries per call, letting the kernel come back for more.
+// Backends implementing ReadDirPager are only asked for those entries. Other backends are still read in full on
+// every call, but only n entries are kept, and entries created or removed while the directory is being listed
+// might be skipped or listed twice.
+func WithReaddirBatchSize(n int) Option {
+	return func(w *wrapper) {
+		w.readdirBatchSize = n
+	}
+}
+
+// WithReadTimeout makes each read from the backend fail with ETIMEDOUT if it doesn't complete within d.
+// The backend call keeps running in its own goroutine, so a backend that never returns leaks a goroutine and a
+// buffer the size of the read per timed out call.
+func WithReadTimeout(d time.Duration) Option {
+	return func(w *wrapper) {
+		w.readTimeout = d
+	}
+}
+
+// WithWriteTimeout makes each write to the backend fail with ETIMEDOUT if it doesn't complete within d.
+// The write might still happen after the timeout. Like with WithReadTimeout, a backend that never returns leaks a
+// goroutine and a copy of the data per timed out call.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(w *wrapper) {
+		w.writeTimeout = d
+	}
+}
+
+// WithReadyFunc calls f from Init, once the mount is serving requests.
+// This lets the caller wait for the mount to be live before using the mount point.
+func WithReadyFunc(f func()) Option {
+	return func(w *wrapper) {
+		w.ready = f
+	}
+}
+
+// WithOverlay layers the filesystem passed to New (or SwapUnderlying) over lower, which is never modified.
+// Files are looked up in the upper filesystem first. Modifications always go to the upper filesystem, and files
+// from lower are copied up when they are first modified. Files that exist in lower can't be removed or renamed;
+// renames fail with EXDEV, so tools like mv fall back to copying. Directories from lower can't be renamed even with
+// WithOverlayWhiteouts.
+func WithOverlay(lower billy.Basic) Option {
+	return func(w *wrapper) {
+		w.overlayLower = lower
+	}
+}
+
+// WithAsyncRelease closes files in the background, so a slow Close on the backend doesn't block other operations.
+// The file descriptor can't be used anymore once Release returns, but errors from closing the file can't be reported
+// to the kernel and are only logged. Destroy waits for pending closes.
+func WithAsyncRelease() Option {
+	return func(w *wrapper) {
+		w.asyncRelease = true
+	}
+}
+
+// WithReaddirFilter leaves entries for which filter returns false out of directory listings.
+// It only affects Readdir: hidden files can still be accessed by anyone who knows their name.
+func WithReaddirFilter(filter func(name string, fi os.FileInfo) bool) Option {
+	return func(w *wrapper) {
+		w.readdirFilter = filter
+	}
+}
+
+// WithVirtualFile adds a read-only file at path whose contents are generated by contents, hiding any file on the
+// backend with the same name. contents is called for every Getattr and Open, and for every listing of its directory.
+// Trying to modify the file results in EROFS. It can be given multiple times to add multiple files.
+func WithVirtualFile(path string, contents func() ([]byte, error)) Option {
+	return func(w *wrapper) {
+		if w.virtualFiles == nil {
+			w.virtualFiles = map[string]func() ([]byte, error){}
+		}
+		w.virtualFiles[gopath.Clean("/"+path)] = contents
+	}
+}
+
+// WithRetry retries backend calls in Open, Create, Read, Write and Getattr that fail with an error for which
+// isRetryable returns true, up to attempts calls in total. The first retry waits backoff, and the wait doubles for
+// every next one. If isRetryable is nil, timeouts and errors with a Temporary method returning true are retried.
+func WithRetry(attempts int, backoff time.Duration, isRetryable func(error) bool) Option {
+	return func(w *wrapper) {
+		if isRetryable == nil {
+			isRetryable = isTemporary
+		}
+		w.retryAttempts = attempts
+		w.retryBackoff = backoff
+		w.isRetryable = isRetryable
+	}
+}
+
+// WithReadOnlyPaths makes paths matching any of the patterns read-only, along with everything below them.
+// The patterns use the syntax of path.Match and are matched against the full path, like "/config" or "/*/secrets".
+// Modifying a read-only path results in EROFS, without asking the backend.
+func WithReadOnlyPaths(patterns ...string) Option {
+	return func(w *wrapper) {
+		for _, p := range patterns {
+			w.readOnlyPaths = append(w.readOnlyPaths, gopath.Clean("/"+p))
+		}
+	}
+}
+
+// WithTouchParentOnModify sets the modification time of the parent directory after Create, Mknod, Mkdir, Unlink and
+// Rmdir, so tools watching directories notice. Use it for backends that don't update directory times themselves.
+func WithTouchParentOnModify() Option {
+	return func(w *wrapper) {
+		w.touchParents = true
+	}
+}
+
+// WithConcurrencyLimit allows at most n backend calls from Open, Create, Read, Write, Getattr and WithReadAhead
+// prefetches at the same time.
+// Other calls wait for their turn, for at most the duration given to WithOpenTimeout, WithReadTimeout or
+// WithWriteTimeout. A call that timed out frees its slot, even if the backend is still working on it.
+// Zero means no limit.
+func WithConcurrencyLimit(n int) Option {
+	return func(w *wrapper) {
+		if n > 0 {
+			w.concurrency = make(chan struct{}, n)
+		} else {
+			w.concurrency = nil
+		}
+	}
+}
+
+// WithAuditLog calls f with an AuditEntry for every operation that modifies the filesystem, successful or not.
+// f is called from a separate goroutine, so it doesn't slow down the operations. If it falls too far behind, entries
+// are dropped and logged instead. Destroy waits for pending entries.
+func WithAuditLog(f func(AuditEntry)) Option {
+	return func(w *wrapper) {
+		w.auditor = &auditor{
+			f:    f,
+			ch:   make(chan AuditEntry, auditBufferSize),
+			done: make(chan struct{}),
+		}
+	}
+}
+
+// WithAuditReads makes WithAuditLog include reads.
+func WithAuditReads() Option {
+	return func(w *wrapper) {
+		w.auditReads = true
+	}
+}
+
+// WithContentTransform passes data written through the mount through enc before it reaches the backend, and data
+// read from the backend through dec. Reads and writes happen at arbitrary offsets and lengths, so the functions
+// must return as many bytes as they're given, and the result for a byte mustn't depend on its position or
+// neighbours, like a byte substitution or an XOR with a constant. Block-based compression or encryption doesn't
+// satisfy that. Errors from the functions, and changed lengths, result in EIO. Truncate extends files with encoded
+// zeros, but holes left by writing past the end of a file are filled by the backend and are decoded as they are.
+func WithContentTransform(enc, dec func([]byte) ([]byte, error)) Option {
+	return func(w *wrapper) {
+		w.encode = enc
+		w.decode = dec
+	}
+}
+
+// WithStrictReaddir makes Readdir fail if the backend returns an error along with a partial listing.
+// By default the entries that could be read are listed and the error is logged, like ls tolerates unreadable entries.
+func WithStrictReaddir() Option {
+	return func(w *wrapper) {
+		w.strictReaddir = true
+	}
+}
+
+// WithMknodDevices allows Mknod to create character and block devices, for backends implementing Mknoder.
+// Without it, creating device nodes fails with EPERM.
+func WithMknodDevices() Option {
+	return func(w *wrapper) {
+		w.mknodDevices = true
+	}
+}
+
+// WithMaxFileSize makes Write and Truncate fail with EFBIG if they would make a file larger than n bytes.
+func WithMaxFileSize(n int64) Option {
+	return func(w *wrapper) {
+		w.maxFileSize = n
+	}
+}
+
+// WithReadReplicas spreads Getattr, Readdir and opening files for reading over the given replicas of the filesystem
+// passed to New, in turn. Anything that fails on a replica is retried on the primary. Replicas might lag behind the
+// primary, so a file that was just modified can show its old attributes or contents for a while. Like the primary,
+// replicas are seen through WithStripPrefix and WithOverlay.
+func WithReadReplicas(replicas ...billy.Basic) Option {
+	return func(w *wrapper) {
+		w.readReplicas = append(w.readReplicas, replicas...)
+	}
+}
+
+// WithOnClose calls f after a file was closed successfully in Release, with the number of bytes written through
+// that file descriptor. That is zero for files that were only read.
+func WithOnClose(f func(path string, bytesWritten int64)) Option {
+	return func(w *wrapper) {
+		w.onClose = f
+	}
+}
+
+// WithRootMode sets the permissions Getattr reports for the root of the mount, regardless of what the backend says.
+// This controls who can enter the mount.
+func WithRootMode(mode os.FileMode) Option {
+	return func(w *wrapper) {
+		w.rootMode = &mode
+	}
+}
+
+// WithEventEmitter calls f after every successful operation that changes the filesystem, like fsnotify would.
+// f is called synchronously before the result is returned to the kernel, so it should be quick and must not access
+// the mount itself.
+func WithEventEmitter(f func(Event)) Option {
+	return func(w *wrapper) {
+		w.emitter = f
+	}
+}
+
+// WithOpenFlagsValidation makes Open and Create reject nonsensical flags, like O_RDONLY|O_TRUNC, with EINVAL
+// rather than passing them to the backend. Opening for writing on a backend that doesn't report
+// billy.WriteCapability fails with EROFS.
+func WithOpenFlagsValidation() Option {
+	return func(w *wrapper) {
+		w.validateOpenFlags = true
+	}
+}
+
+// WithMemoryBudget limits the memory used by the buffers of all open files together to bytes. Currently that's
+// the buffers of WithReadAhead: once the budget is used up, files don't prefetch until other files free their
+// buffers by being closed, modified or read past their buffer.
+func WithMemoryBudget(bytes int64) Option {
+	return func(w *wrapper) {
+		w.memoryBudget = &memoryBudget{limit: bytes}
+	}
+}
+
+// WithDefaultTimestamps reports t as the modification, access and change time of files for which the backend
+// doesn't have a modification time, rather than 1970. If t is the zero time, the current time is used. Files that do
+// have a modification time report it as their access and change time too.
+func WithDefaultTimestamps(t time.Time) Option {
+	return func(w *wrapper) {
+		w.defaultTimestamps = true
+		w.defaultTime = t
+	}
+}
+
+// WithWriteThroughAttrUpdate makes Getattr report at least the size that Write and Truncate through open files gave
+// a file, for backends whose Stat lags behind writes. Otherwise tail and wc might not see data that was just
+// written.
+func WithWriteThroughAttrUpdate() Option {
+	return func(w *wrapper) {
+		w.writeThroughAttrs = true
+	}
+}
+
+// WithReadOnlyAfter makes the mount read-only once the clock passes t: from then on, everything that would modify
+// the filesystem fails with EROFS. Files that are already open for writing can't be written to anymore either.
+func WithReadOnlyAfter(t time.Time) Option {
+	return func(w *wrapper) {
+		w.readOnlyAfter = &t
+	}
+}
+
+// WithLivenessProbe checks whether the backend is reachable every interval, by calling Stat("/") like Ping does.
+// onDown is called with the error when a check fails after the previous one succeeded, and onUp is called when a
+// check succeeds again. Either can be nil. The probe runs from Init until Destroy. An interval of 0 disables it.
+func WithLivenessProbe(interval time.Duration, onDown func(error), onUp func()) Option {
+	return func(w *wrapper) {
+		if interval <= 0 {
+			w.liveness = nil
+			return
+		}
+		w.liveness = &livenessProbe{
+			interval: interval,
+			onDown:   onDown,
+			onUp:     onUp,
+			stop:     make(chan struct{}),
+			done:     make(chan struct{}),
+		}
+	}
+}
+
+// WithStripPrefix exposes the directory prefix of the filesystem passed to New (or SwapUnderlying) as the root of the
+// mount, so "data/foo" on the backend appears as "/foo" with a prefix of "data". Absolute symlink targets are
+// translated as well. Optional interfaces of the backend, like StatFSer, aren't available through the prefix.
+func WithStripPrefix(prefix string) Option {
+	return func(w *wrapper) {
+		w.stripPrefix = gopath.Clean("/" + prefix)
+		if w.stripPrefix == "/" {
+			w.stripPrefix = ""
+		}
+	}
+}
+
+// WithMaxOpensPerPath limits the number of files that can be open at the same time for a single path to n.
+// Opening more results in EMFILE. A limit of 0 means no limit.
+func WithMaxOpensPerPath(n int) Option {
+	return func(w *wrapper) {
+		w.maxOpensPerPath = n
+		w.openCounts = map[string]int{}
+	}
+}
+
+// WithStatfsFileCount makes Statfs count the files and directories on backends that don't implement StatFSer, and
+// report them as used inodes, so df -i shows something useful. Counting walks the whole backend, so the count is
+// reused for ttl.
+func WithStatfsFileCount(ttl time.Duration) Option {
+	return func(w *wrapper) {
+		w.fileCounter = &fileCounter{ttl: ttl}
+	}
+}
+
+// WithChmodMask makes Chmod drop the permission bits that aren't in allowed, like os.ModeSetuid and os.ModeSetgid,
+// whatever the backend would allow.
+func WithChmodMask(allowed os.FileMode) Option {
+	return func(w *wrapper) {
+		w.chmodMask = &allowed
+	}
+}
+
+// WithStrictChmodMask makes Chmod fail with EPERM if it's asked to set bits not allowed by WithChmodMask, rather
+// than dropping them.
+func WithStrictChmodMask() Option {
+	return func(w *wrapper) {
+		w.strictChmodMask = true
+	}
+}
+
+// WithOverlayWhiteouts lets files from the lower filesystem of WithOverlay be removed and renamed. They're hidden by
+// an empty whiteout file named ".wh.<name>" in the upper filesystem, which isn't listed by Readdir.
+func WithOverlayWhiteouts() Option {
+	return func(w *wrapper) {
+		w.overlayWhiteouts = true
+	}
+}
+
+// WithNoExec hides the execute bits of everything but directories, so the kernel refuses to execute files from the
+// mount and Access fails for X_OK, like the noexec mount option.
+func WithNoExec() Option {
+	return func(w *wrapper) {
+		w.noExec = true
+	}
+}
+
+// WithSidecarXattrs stores extended attributes in a JSON file next to the file they belong to, so they persist on
+// any backend. The attributes of "foo" are stored in ".foo<suffix>", which Readdir doesn't list while "foo" exists.
+// The sidecar is moved and removed along with its file. security.selinux and system.posix_acl_* can't be set.
+func WithSidecarXattrs(suffix string) Option {
+	return func(w *wrapper) {
+		w.sidecars = &sidecarXattrs{suffix: suffix}
+	}
+}
+
+// WithReadCache keeps the contents of files of at most maxFileSize bytes in memory, up to maxBytes in total, and
+// serves reads from there. The least recently used files are evicted first. Writes, truncations, removals and
+// renames through the mount drop the cached contents; changes made to the backend directly aren't noticed.
+func WithReadCache(maxBytes int64, maxFileSize int64) Option {
+	return func(w *wrapper) {
+		w.readCache = newReadCache(maxBytes, maxFileSize)
+	}
+}
+
+// WithCallerGroups gives Access and Opendir the supplementary groups of the caller, so members of the group set
+// with WithOwner get its permissions even if it isn't their primary group. f is called during the operation, so it
+// can use fuse.Getcontext to find out who the caller is. Without it, only the primary group is considered.
+func WithCallerGroups(f func() []uint32) Option {
+	return func(w *wrapper) {
+		w.callerGroups = f
+	}
+}
+
+// WithTruncateBlockAlign makes Truncate round the requested size to a multiple of size, for backends that can only
+// size files in whole blocks. With roundUp the size is rounded up, so the file ends up larger than requested and the
+// extra bytes read as zeros; they're written explicitly if the backend doesn't extend the file itself. Otherwise
+// the size is rounded down and the file ends up smaller than requested.
+func WithTruncateBlockAlign(size int64, roundUp bool) Option {
+	return func(w *wrapper) {
+		w.truncateBlockSize = size
+		w.truncateRoundUp = roundUp
+	}
+}
+
+// WithOpenRetryOnNotExist makes Open and Getattr try up to attempts times, waiting delay in between, if the backend
+// says the file doesn't exist. That smooths over eventually consistent backends that don't show a new file right
+// away, at the cost of slowing down lookups of files that really don't exist.
+func WithOpenRetryOnNotExist(attempts int, delay time.Duration) Option {
+	return func(w *wrapper) {
+		w.notExistAttempts = attempts
+		w.notExistDelay = delay
+	}
+}
@@ -0,0 +1,373 @@
+package billycgofuse
+
+import (
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// overlayFS is a billy filesystem that layers a writable upper filesystem over a read-only lower one.
+// Reads go to the upper layer first and fall back to the lower layer. All modifications go to the upper layer, and
+// files from the lower layer are copied up when they are first modified.
+// Files that only exist in the lower layer can't be removed, and removing a file from the upper layer makes the
+// version in the lower layer (if any) visible again. With whiteouts, removing a file from the lower layer creates a
+// whiteout file in the upper layer that hides it, and everything below it.
+type overlayFS struct {
+	upper     billy.Basic
+	lower     billy.Basic
+	whiteouts bool
+}
+
+// whiteoutPrefix is prepended to the name of a whiteout file, like aufs does.
+const whiteoutPrefix = ".wh."
+
+// whiteoutPath returns the path of the whiteout file for filename.
+func whiteoutPath(filename string) string {
+	return path.Join(path.Dir(filename), whiteoutPrefix+path.Base(filename))
+}
+
+// hidden returns whether filename, or a directory containing it, was removed from the lower layer with a whiteout.
+func (o *overlayFS) hidden(filename string) bool {
+	if !o.whiteouts {
+		return false
+	}
+	for p := path.Clean("/" + filename); p != "/"; p = path.Dir(p) {
+		if _, err := lstatFS(o.upper, whiteoutPath(p)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// lowerLstat is lstatFS on the lower layer, except that hidden files don't exist.
+func (o *overlayFS) lowerLstat(filename string) (os.FileInfo, error) {
+	if o.hidden(filename) {
+		return nil, &os.PathError{Op: "lstat", Path: filename, Err: os.ErrNotExist}
+	}
+	return lstatFS(o.lower, filename)
+}
+
+func (o *overlayFS) Create(filename string) (billy.File, error) {
+	return o.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (o *overlayFS) Open(filename string) (billy.File, error) {
+	return o.OpenFile(filename, os.O_RDONLY, 0)
+}
+
+func (o *overlayFS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) == 0 {
+		fh, err := o.upper.OpenFile(filename, flag, perm)
+		if os.IsNotExist(err) && !o.hidden(filename) {
+			return o.lower.OpenFile(filename, flag, perm)
+		}
+		return fh, err
+	}
+	if err := o.copyUp(filename, flag&os.O_TRUNC == 0); err != nil {
+		return nil, err
+	}
+	return o.upper.OpenFile(filename, flag, perm)
+}
+
+func (o *overlayFS) Stat(filename string) (os.FileInfo, error) {
+	fi, err := o.upper.Stat(filename)
+	if os.IsNotExist(err) && !o.hidden(filename) {
+		return o.lower.Stat(filename)
+	}
+	return fi, err
+}
+
+func (o *overlayFS) Rename(oldpath, newpath string) error {
+	lfi, err := o.lowerLstat(oldpath)
+	inLower := err == nil
+	// Copying up a directory only creates an empty one, so its lower contents would be lost. Without whiteouts, the
+	// lower version of a file would keep showing up at the old name. Like overlayfs, refuse and let the caller fall
+	// back to copying.
+	if inLower && (lfi.IsDir() || !o.whiteouts) {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+	}
+	if err := o.copyUp(oldpath, true); err != nil {
+		return err
+	}
+	if err := o.copyUpParent(newpath); err != nil {
+		return err
+	}
+	if err := o.upper.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	if inLower {
+		// Don't let the lower version show up at the old name again.
+		return o.whiteout(oldpath)
+	}
+	return nil
+}
+
+func (o *overlayFS) Remove(filename string) error {
+	if o.whiteouts {
+		return o.removeWithWhiteout(filename)
+	}
+	err := o.upper.Remove(filename)
+	if os.IsNotExist(err) {
+		if _, lerr := lstatFS(o.lower, filename); lerr == nil {
+			return &os.PathError{Op: "remove", Path: filename, Err: billy.ErrReadOnly}
+		}
+	}
+	return err
+}
+
+// removeWithWhiteout removes filename from the upper layer, and hides it in the lower layer with a whiteout.
+func (o *overlayFS) removeWithWhiteout(filename string) error {
+	lfi, lerr := o.lowerLstat(filename)
+	inLower := lerr == nil
+	if ufi, err := lstatFS(o.upper, filename); err == nil && ufi.IsDir() || inLower && lfi.IsDir() {
+		// The directory might only contain whiteouts in the upper layer, which keep the backend from removing it.
+		entries, err := o.ReadDir(filename)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return &os.PathError{Op: "remove", Path: filename, Err: syscall.ENOTEMPTY}
+		}
+		if err := o.removeWhiteouts(filename); err != nil {
+			return err
+		}
+	}
+	if err := o.upper.Remove(filename); err != nil && !(inLower && os.IsNotExist(err)) {
+		return err
+	}
+	if inLower {
+		return o.whiteout(filename)
+	}
+	return nil
+}
+
+// whiteout creates a whiteout file for filename in the upper layer.
+func (o *overlayFS) whiteout(filename string) error {
+	if err := o.copyUpParent(filename); err != nil {
+		return err
+	}
+	f, err := o.upper.OpenFile(whiteoutPath(filename), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// removeWhiteouts removes the whiteout files in directory dirname of the upper layer.
+func (o *overlayFS) removeWhiteouts(dirname string) error {
+	entries, err := readDirFS(o.upper, dirname)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), whiteoutPrefix) {
+			if err := o.upper.Remove(path.Join(dirname, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (o *overlayFS) Join(elem ...string) string {
+	return o.upper.Join(elem...)
+}
+
+// ReadDir merges the listings of both layers, with entries from the upper layer hiding those of the lower layer.
+// Whiteout files hide the entries they are for, and aren't listed themselves.
+func (o *overlayFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	upper, uerr := readDirFS(o.upper, dirname)
+	var lower []os.FileInfo
+	lerr := error(&os.PathError{Op: "readdir", Path: dirname, Err: os.ErrNotExist})
+	if !o.hidden(dirname) {
+		lower, lerr = readDirFS(o.lower, dirname)
+	}
+	if uerr != nil && (lerr != nil || !os.IsNotExist(uerr)) {
+		return nil, uerr
+	}
+	if lerr != nil && !os.IsNotExist(lerr) {
+		return nil, lerr
+	}
+	seen := make(map[string]bool, len(upper))
+	ret := make([]os.FileInfo, 0, len(upper)+len(lower))
+	for _, e := range upper {
+		if o.whiteouts && strings.HasPrefix(e.Name(), whiteoutPrefix) {
+			seen[strings.TrimPrefix(e.Name(), whiteoutPrefix)] = true
+			continue
+		}
+		seen[e.Name()] = true
+		ret = append(ret, e)
+	}
+	for _, e := range lower {
+		if !seen[e.Name()] {
+			ret = append(ret, e)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name() < ret[j].Name()
+	})
+	return ret, nil
+}
+
+func (o *overlayFS) MkdirAll(filename string, perm os.FileMode) error {
+	dfs, ok := o.upper.(billy.Dir)
+	if !ok {
+		return billy.ErrNotSupported
+	}
+	return dfs.MkdirAll(filename, perm)
+}
+
+func (o *overlayFS) Lstat(filename string) (os.FileInfo, error) {
+	fi, err := lstatFS(o.upper, filename)
+	if os.IsNotExist(err) {
+		return o.lowerLstat(filename)
+	}
+	return fi, err
+}
+
+func (o *overlayFS) Symlink(target, link string) error {
+	sfs, ok := o.upper.(billy.Symlink)
+	if !ok {
+		return billy.ErrNotSupported
+	}
+	if err := o.copyUpParent(link); err != nil {
+		return err
+	}
+	return sfs.Symlink(target, link)
+}
+
+func (o *overlayFS) Readlink(link string) (string, error) {
+	if sfs, ok := o.upper.(billy.Symlink); ok {
+		target, err := sfs.Readlink(link)
+		if !os.IsNotExist(err) {
+			return target, err
+		}
+	}
+	if sfs, ok := o.lower.(billy.Symlink); ok && !o.hidden(link) {
+		return sfs.Readlink(link)
+	}
+	return "", &os.PathError{Op: "readlink", Path: link, Err: os.ErrNotExist}
+}
+
+func (o *overlayFS) Chmod(name string, mode os.FileMode) error {
+	cfs, err := o.upperChange(name)
+	if err != nil {
+		return err
+	}
+	return cfs.Chmod(name, mode)
+}
+
+func (o *overlayFS) Lchown(name string, uid, gid int) error {
+	cfs, err := o.upperChange(name)
+	if err != nil {
+		return err
+	}
+	return cfs.Lchown(name, uid, gid)
+}
+
+func (o *overlayFS) Chown(name string, uid, gid int) error {
+	cfs, err := o.upperChange(name)
+	if err != nil {
+		return err
+	}
+	return cfs.Chown(name, uid, gid)
+}
+
+func (o *overlayFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	cfs, err := o.upperChange(name)
+	if err != nil {
+		return err
+	}
+	return cfs.Chtimes(name, atime, mtime)
+}
+
+// upperChange copies name up and returns the upper layer as a billy.Change.
+func (o *overlayFS) upperChange(name string) (billy.Change, error) {
+	cfs, ok := o.upper.(billy.Change)
+	if !ok {
+		return nil, billy.ErrNotSupported
+	}
+	return cfs, o.copyUp(name, true)
+}
+
+// copyUp copies filename from the lower to the upper layer if it only exists in the lower layer.
+// If withData is false, only an empty file is created, for callers that are going to truncate it anyway.
+// Files that exist in neither layer just get their parent directory copied up, so they can be created.
+func (o *overlayFS) copyUp(filename string, withData bool) error {
+	if _, err := lstatFS(o.upper, filename); !os.IsNotExist(err) {
+		return err
+	}
+	fi, err := o.lowerLstat(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return o.copyUpParent(filename)
+		}
+		return err
+	}
+	if err := o.copyUpParent(filename); err != nil {
+		return err
+	}
+	switch {
+	case fi.IsDir():
+		return o.MkdirAll(filename, fi.Mode().Perm())
+	case fi.Mode()&os.ModeSymlink != 0:
+		target, err := o.Readlink(filename)
+		if err != nil {
+			return err
+		}
+		return o.Symlink(target, filename)
+	}
+	dst, err := o.upper.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if withData {
+		src, err := o.lower.Open(filename)
+		if err != nil {
+			dst.Close()
+			return err
+		}
+		_, err = io.Copy(dst, src)
+		src.Close()
+		if err != nil {
+			dst.Close()
+			return err
+		}
+	}
+	return dst.Close()
+}
+
+// copyUpParent makes sure the parent directory of filename exists in the upper layer.
+func (o *overlayFS) copyUpParent(filename string) error {
+	dir := path.Dir(filename)
+	if dir == filename {
+		return nil
+	}
+	return o.copyUp(dir, false)
+}
+
+// lstatFS stats filename without following a symlink at the end, if fs supports symlinks.
+func lstatFS(fs billy.Basic, filename string) (os.FileInfo, error) {
+	if sfs, ok := fs.(billy.Symlink); ok {
+		return sfs.Lstat(filename)
+	}
+	return fs.Stat(filename)
+}
+
+// readDirFS lists a directory of fs, if fs supports directories.
+func readDirFS(fs billy.Basic, dirname string) ([]os.FileInfo, error) {
+	dfs, ok := fs.(billy.Dir)
+	if !ok {
+		return nil, &os.PathError{Op: "readdir", Path: dirname, Err: os.ErrNotExist}
+	}
+	return dfs.ReadDir(dirname)
+}
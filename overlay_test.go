@@ -0,0 +1,56 @@
+package billycgofuse
+
+import (
+	"testing"
+
+	"github.com/billziss-gh/cgofuse/fuse"
+	"github.com/go-git/go-billy/v5/memfs"
+)
+
+func TestOverlayRenameLowerDirectory(t *testing.T) {
+	lower := memfs.New()
+	writeFile(t, lower, "/dir/file", "hello")
+	writeFile(t, lower, "/file", "hello")
+	fs := New(memfs.New(), WithOverlay(lower), WithOverlayWhiteouts())
+	if errc := fs.Rename("/dir", "/moved"); errc != -fuse.EXDEV {
+		t.Errorf("Rename(%q) = %d, want %d", "/dir", errc, -fuse.EXDEV)
+	}
+	var st fuse.Stat_t
+	if errc := fs.Getattr("/dir/file", &st, ^uint64(0)); errc != 0 {
+		t.Errorf("Getattr(%q) after failed Rename = %d, want 0", "/dir/file", errc)
+	}
+	// Files are copied up whole, so they can be renamed.
+	if errc := fs.Rename("/file", "/dir/renamed"); errc != 0 {
+		t.Errorf("Rename(%q) = %d, want 0", "/file", errc)
+	}
+	if errc := fs.Getattr("/dir/renamed", &st, ^uint64(0)); errc != 0 || st.Size != 5 {
+		t.Errorf("Getattr(%q) = %d with size %d, want the renamed file", "/dir/renamed", errc, st.Size)
+	}
+	if errc := fs.Getattr("/file", &st, ^uint64(0)); errc != -fuse.ENOENT {
+		t.Errorf("Getattr(%q) = %d, want %d", "/file", errc, -fuse.ENOENT)
+	}
+}
+
+func TestOverlayRenameLowerFileWithoutWhiteouts(t *testing.T) {
+	lower := memfs.New()
+	writeFile(t, lower, "/f", "hello")
+	fs, upper := newTestFS(t, WithOverlay(lower))
+	writeFile(t, upper, "/u", "hello")
+	if errc := fs.Rename("/f", "/g"); errc != -fuse.EXDEV {
+		t.Errorf("Rename(%q) = %d, want %d", "/f", errc, -fuse.EXDEV)
+	}
+	var st fuse.Stat_t
+	if errc := fs.Getattr("/f", &st, ^uint64(0)); errc != 0 {
+		t.Errorf("Getattr(%q) after failed Rename = %d, want 0", "/f", errc)
+	}
+	if errc := fs.Getattr("/g", &st, ^uint64(0)); errc != -fuse.ENOENT {
+		t.Errorf("Getattr(%q) after failed Rename = %d, want %d", "/g", errc, -fuse.ENOENT)
+	}
+	// Files that only exist in the upper layer can still be renamed.
+	if errc := fs.Rename("/u", "/v"); errc != 0 {
+		t.Errorf("Rename(%q) = %d, want 0", "/u", errc)
+	}
+	if errc := fs.Getattr("/u", &st, ^uint64(0)); errc != -fuse.ENOENT {
+		t.Errorf("Getattr(%q) after Rename = %d, want %d", "/u", errc, -fuse.ENOENT)
+	}
+}
@@ -0,0 +1,59 @@
+package billycgofuse
+
+import (
+	"sort"
+	"sync"
+)
+
+// pathLocker hands out a mutex per path.
+// Entries are removed when nobody holds or waits for them, so deleted paths don't leak.
+type pathLocker struct {
+	mtx   sync.Mutex
+	locks map[string]*pathLock
+}
+
+type pathLock struct {
+	sync.Mutex
+	refs int
+}
+
+func newPathLocker() *pathLocker {
+	return &pathLocker{
+		locks: map[string]*pathLock{},
+	}
+}
+
+// lock locks all given paths and returns a function that unlocks them.
+// Paths are locked in sorted order so concurrent callers can't deadlock.
+func (pl *pathLocker) lock(paths ...string) func() {
+	sorted := append([]string(nil), paths...)
+	sort.Strings(sorted)
+	held := make([]string, 0, len(sorted))
+	for i, p := range sorted {
+		if i > 0 && sorted[i-1] == p {
+			continue
+		}
+		pl.mtx.Lock()
+		l, ok := pl.locks[p]
+		if !ok {
+			l = &pathLock{}
+			pl.locks[p] = l
+		}
+		l.refs++
+		pl.mtx.Unlock()
+		l.Lock()
+		held = append(held, p)
+	}
+	return func() {
+		pl.mtx.Lock()
+		defer pl.mtx.Unlock()
+		for _, p := range held {
+			l := pl.locks[p]
+			l.Unlock()
+			l.refs--
+			if l.refs == 0 {
+				delete(pl.locks, p)
+			}
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package billycgofuse
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"syscall"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// supportsPositionedIO probes whether fh can be read with ReadAt and written with WriteAt, neither of which use the
+// file position. Backends that don't really implement ReadAt fail even an empty one.
+func supportsPositionedIO(fh billy.File) bool {
+	if _, ok := fh.(io.WriterAt); !ok {
+		return false
+	}
+	_, err := fh.ReadAt(nil, 0)
+	return !errors.Is(err, billy.ErrNotSupported) && !errors.Is(err, syscall.ENOSYS)
+}
+
+// seekFile reads and writes a file that doesn't support positioned I/O with Seek and Read or Write.
+// Callers must hold the write lock of the file descriptor. mtx keeps each Seek together with its Read or Write too,
+// because a call that timed out keeps running in the background after the write lock was released.
+type seekFile struct {
+	billy.File
+	mtx *sync.Mutex
+}
+
+func (f seekFile) ReadAt(buff []byte, ofst int64) (int, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if _, err := f.Seek(ofst, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(f.File, buff)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f seekFile) WriteAt(buff []byte, ofst int64) (int, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if _, err := f.Seek(ofst, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return f.File.Write(buff)
+}
@@ -0,0 +1,126 @@
+package billycgofuse
+
+import (
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// prefixFS is a billy filesystem that exposes the directory prefix of fs as its root, for WithStripPrefix.
+// Absolute symlink targets are translated too, so links within the prefix keep working.
+type prefixFS struct {
+	fs     billy.Basic
+	prefix string
+}
+
+// full returns the path on the underlying filesystem for name.
+func (p *prefixFS) full(name string) string {
+	return path.Join(p.prefix, name)
+}
+
+func (p *prefixFS) Create(filename string) (billy.File, error) {
+	return p.fs.Create(p.full(filename))
+}
+
+func (p *prefixFS) Open(filename string) (billy.File, error) {
+	return p.fs.Open(p.full(filename))
+}
+
+func (p *prefixFS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	return p.fs.OpenFile(p.full(filename), flag, perm)
+}
+
+func (p *prefixFS) Stat(filename string) (os.FileInfo, error) {
+	return p.fs.Stat(p.full(filename))
+}
+
+func (p *prefixFS) Rename(oldpath, newpath string) error {
+	return p.fs.Rename(p.full(oldpath), p.full(newpath))
+}
+
+func (p *prefixFS) Remove(filename string) error {
+	return p.fs.Remove(p.full(filename))
+}
+
+func (p *prefixFS) Join(elem ...string) string {
+	return p.fs.Join(elem...)
+}
+
+func (p *prefixFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	return readDirFS(p.fs, p.full(dirname))
+}
+
+func (p *prefixFS) MkdirAll(filename string, perm os.FileMode) error {
+	dfs, ok := p.fs.(billy.Dir)
+	if !ok {
+		return billy.ErrNotSupported
+	}
+	return dfs.MkdirAll(p.full(filename), perm)
+}
+
+func (p *prefixFS) Lstat(filename string) (os.FileInfo, error) {
+	return lstatFS(p.fs, p.full(filename))
+}
+
+// Symlink creates a link. Absolute targets are relative to the root of the mount, so they get the prefix.
+func (p *prefixFS) Symlink(target, link string) error {
+	sfs, ok := p.fs.(billy.Symlink)
+	if !ok {
+		return billy.ErrNotSupported
+	}
+	if path.IsAbs(target) {
+		target = p.full(target)
+	}
+	return sfs.Symlink(target, p.full(link))
+}
+
+// Readlink reads a link. Absolute targets within the prefix lose it. Those outside it are returned as is, because
+// they point outside the mount anyway.
+func (p *prefixFS) Readlink(link string) (string, error) {
+	target, err := readlinkFS(p.fs, p.full(link))
+	if err != nil {
+		return "", err
+	}
+	if target == p.prefix {
+		return "/", nil
+	}
+	if strings.HasPrefix(target, p.prefix+"/") {
+		return target[len(p.prefix):], nil
+	}
+	return target, nil
+}
+
+func (p *prefixFS) Chmod(name string, mode os.FileMode) error {
+	cfs, ok := p.fs.(billy.Change)
+	if !ok {
+		return billy.ErrNotSupported
+	}
+	return cfs.Chmod(p.full(name), mode)
+}
+
+func (p *prefixFS) Lchown(name string, uid, gid int) error {
+	cfs, ok := p.fs.(billy.Change)
+	if !ok {
+		return billy.ErrNotSupported
+	}
+	return cfs.Lchown(p.full(name), uid, gid)
+}
+
+func (p *prefixFS) Chown(name string, uid, gid int) error {
+	cfs, ok := p.fs.(billy.Change)
+	if !ok {
+		return billy.ErrNotSupported
+	}
+	return cfs.Chown(p.full(name), uid, gid)
+}
+
+func (p *prefixFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	cfs, ok := p.fs.(billy.Change)
+	if !ok {
+		return billy.ErrNotSupported
+	}
+	return cfs.Chtimes(p.full(name), atime, mtime)
+}
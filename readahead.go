@@ -0,0 +1,132 @@
+package billycgofuse
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// readAhead prefetches the next region of a file descriptor that is being read sequentially.
+type readAhead struct {
+	size   int
+	budget *memoryBudget
+	// wait is how long a read waits for a prefetch in flight before going to the backend itself. Zero means no limit.
+	wait time.Duration
+
+	mtx     sync.Mutex
+	lastEnd int64
+	// gen is bumped when the file is modified, so prefetches that started before that are discarded.
+	gen     uint64
+	ofst    int64
+	buf     []byte
+	eof     bool
+	pending chan struct{}
+	// held is the number of bytes reserved from budget for buf or the pending prefetch.
+	held int64
+}
+
+func newReadAhead(size int, budget *memoryBudget, wait time.Duration) *readAhead {
+	return &readAhead{
+		size:    size,
+		budget:  budget,
+		wait:    wait,
+		lastEnd: -1,
+	}
+}
+
+// read serves a read from the prefetched data. It returns false if the prefetched data doesn't cover the request.
+func (ra *readAhead) read(buff []byte, ofst int64) (int, bool) {
+	ra.mtx.Lock()
+	if pending := ra.pending; pending != nil && ra.ofst == ofst {
+		// The prefetch we need is in flight. Waiting for it beats issuing a second request.
+		ra.mtx.Unlock()
+		ra.waitFor(pending)
+		ra.mtx.Lock()
+	}
+	defer ra.mtx.Unlock()
+	if ra.pending != nil || ofst < ra.ofst || ofst >= ra.ofst+int64(len(ra.buf)) {
+		return 0, false
+	}
+	n := copy(buff, ra.buf[ofst-ra.ofst:])
+	if n < len(buff) && !ra.eof {
+		return 0, false
+	}
+	return n, true
+}
+
+// waitFor waits until pending is closed or ra.wait has passed.
+func (ra *readAhead) waitFor(pending chan struct{}) {
+	if ra.wait <= 0 {
+		<-pending
+		return
+	}
+	t := time.NewTimer(ra.wait)
+	defer t.Stop()
+	select {
+	case <-pending:
+	case <-t.C:
+	}
+}
+
+// done records that n bytes were read at ofst, and starts a prefetch of the next region with readAt if the reads
+// look sequential.
+func (ra *readAhead) done(readAt func(buff []byte, ofst int64) (int, error), ofst int64, n int) {
+	ra.mtx.Lock()
+	defer ra.mtx.Unlock()
+	sequential := ofst == ra.lastEnd || ofst == 0
+	ra.lastEnd = ofst + int64(n)
+	if !sequential || ra.pending != nil || n == 0 {
+		return
+	}
+	next := ra.lastEnd
+	if next >= ra.ofst && next < ra.ofst+int64(len(ra.buf)) {
+		// Still serving from the current buffer.
+		return
+	}
+	if ra.eof && next >= ra.ofst+int64(len(ra.buf)) && len(ra.buf) > 0 {
+		return
+	}
+	ra.drop()
+	if !ra.budget.reserve(int64(ra.size)) {
+		// Over the memory budget. Reads will go to the backend until other buffers are freed.
+		return
+	}
+	ra.held = int64(ra.size)
+	pending := make(chan struct{})
+	ra.pending = pending
+	ra.ofst = next
+	gen := ra.gen
+	go func() {
+		defer close(pending)
+		buf := make([]byte, ra.size)
+		n, err := readAt(buf, next)
+		ra.mtx.Lock()
+		defer ra.mtx.Unlock()
+		ra.pending = nil
+		if ra.gen != gen || (err != nil && err != io.EOF) {
+			ra.drop()
+			return
+		}
+		ra.buf = buf[:n]
+		ra.eof = err == io.EOF
+	}()
+}
+
+// invalidate drops prefetched data, because the file was modified or closed.
+func (ra *readAhead) invalidate() {
+	ra.mtx.Lock()
+	defer ra.mtx.Unlock()
+	ra.gen++
+	ra.drop()
+}
+
+// drop discards the prefetched data and returns its memory to the budget. A pending prefetch keeps its memory until
+// it finishes. ra.mtx must be held.
+func (ra *readAhead) drop() {
+	ra.buf = nil
+	ra.eof = false
+	if ra.pending == nil {
+		ra.budget.free(ra.held)
+		ra.held = 0
+	}
+}
@@ -0,0 +1,188 @@
+package billycgofuse
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+)
+
+var errBackendDown = errors.New("backend down")
+
+// slowFS wraps a filesystem to make every read of its files take delay, like a backend with a high latency per
+// request. It counts the reads and how many of them were in flight at most, and fails them while failReads is set.
+// If hang is set, reads after the first hangAfter block until it's closed.
+type slowFS struct {
+	billy.Filesystem
+	delay       time.Duration
+	reads       int64
+	inFlight    int64
+	maxInFlight int64
+	failReads   int32
+	hang        chan struct{}
+	hangAfter   int64
+}
+
+func (fs *slowFS) Open(filename string) (billy.File, error) {
+	return fs.OpenFile(filename, os.O_RDONLY, 0)
+}
+
+func (fs *slowFS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	f, err := fs.Filesystem.OpenFile(filename, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &slowFile{File: f, fs: fs}, nil
+}
+
+// read simulates the latency of a read, and returns an error if reads are failing.
+func (fs *slowFS) read() error {
+	n := atomic.AddInt64(&fs.inFlight, 1)
+	defer atomic.AddInt64(&fs.inFlight, -1)
+	for {
+		max := atomic.LoadInt64(&fs.maxInFlight)
+		if n <= max || atomic.CompareAndSwapInt64(&fs.maxInFlight, max, n) {
+			break
+		}
+	}
+	time.Sleep(fs.delay)
+	if reads := atomic.AddInt64(&fs.reads, 1); fs.hang != nil && reads > fs.hangAfter {
+		<-fs.hang
+	}
+	if atomic.LoadInt32(&fs.failReads) != 0 {
+		return errBackendDown
+	}
+	return nil
+}
+
+type slowFile struct {
+	billy.File
+	fs *slowFS
+}
+
+func (f *slowFile) Read(buff []byte) (int, error) {
+	if err := f.fs.read(); err != nil {
+		return 0, err
+	}
+	return f.File.Read(buff)
+}
+
+func (f *slowFile) ReadAt(buff []byte, ofst int64) (int, error) {
+	if err := f.fs.read(); err != nil {
+		return 0, err
+	}
+	return f.File.ReadAt(buff, ofst)
+}
+
+// newSlowFS returns a slowFS on a new in-memory filesystem with a file of size bytes at /file.
+func newSlowFS(t testing.TB, delay time.Duration, size int) (*slowFS, []byte) {
+	t.Helper()
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	bfs := memfs.New()
+	writeFile(t, bfs, "/file", string(data))
+	return &slowFS{Filesystem: bfs, delay: delay}, data
+}
+
+func TestReadAheadSequential(t *testing.T) {
+	bfs, data := newSlowFS(t, time.Millisecond, 64<<10)
+	fs := New(bfs, WithReadAhead(4096))
+	fd := open(t, fs, "/file", os.O_RDONLY)
+	defer fs.Release("/file", fd)
+	// Each read right after the previous one lands on the prefetch that is still in flight.
+	buff := make([]byte, 4096)
+	for ofst := 0; ofst < len(data); ofst += len(buff) {
+		if n := fs.Read("/file", buff, int64(ofst), fd); n != len(buff) {
+			t.Fatalf("Read(%d) = %d, want %d", ofst, n, len(buff))
+		}
+		if !bytes.Equal(buff, data[ofst:ofst+len(buff)]) {
+			t.Fatalf("Read(%d) returned the wrong data", ofst)
+		}
+	}
+}
+
+func TestReadAheadServesPrefetchedData(t *testing.T) {
+	bfs, data := newSlowFS(t, 0, 8192)
+	fs := New(bfs, WithReadAhead(4096))
+	fd := open(t, fs, "/file", os.O_RDONLY)
+	defer fs.Release("/file", fd)
+	buff := make([]byte, 4096)
+	if n := fs.Read("/file", buff, 0, fd); n != len(buff) {
+		t.Fatalf("Read(0) = %d, want %d", n, len(buff))
+	}
+	// Wait for the prefetch of the second half to have read from the backend.
+	for atomic.LoadInt64(&bfs.reads) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	atomic.StoreInt32(&bfs.failReads, 1)
+	if n := fs.Read("/file", buff, 4096, fd); n != len(buff) {
+		t.Fatalf("Read(4096) = %d, want %d from the prefetched data", n, len(buff))
+	}
+	if !bytes.Equal(buff, data[4096:]) {
+		t.Errorf("Read(4096) returned the wrong data")
+	}
+}
+
+func TestReadAheadHangingPrefetch(t *testing.T) {
+	bfs, _ := newSlowFS(t, 0, 8192)
+	bfs.hang = make(chan struct{})
+	bfs.hangAfter = 1
+	defer close(bfs.hang)
+	fs := New(bfs, WithReadAhead(4096), WithReadTimeout(50*time.Millisecond))
+	fd := open(t, fs, "/file", os.O_RDONLY)
+	buff := make([]byte, 4096)
+	if n := fs.Read("/file", buff, 0, fd); n != len(buff) {
+		t.Fatalf("Read(0) = %d, want %d", n, len(buff))
+	}
+	// The prefetch of the next block hangs. A read of that block gives up on it after the read timeout, and then
+	// times out on the backend itself.
+	done := make(chan int)
+	go func() {
+		done <- fs.Read("/file", buff, 4096, fd)
+	}()
+	select {
+	case n := <-done:
+		if n >= 0 {
+			t.Errorf("Read(4096) = %d, want an error", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Read(4096) is stuck waiting for the prefetch")
+	}
+}
+
+func BenchmarkReadAhead(b *testing.B) {
+	const fileSize = 1 << 20
+	const readSize = 32 << 10
+	for _, bc := range []struct {
+		name string
+		opts []Option
+	}{
+		{"off", nil},
+		{"128KiB", []Option{WithReadAhead(128 << 10)}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			bfs, _ := newSlowFS(b, time.Millisecond, fileSize)
+			fs := New(bfs, bc.opts...)
+			buff := make([]byte, readSize)
+			b.SetBytes(fileSize)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				fd := open(b, fs, "/file", os.O_RDONLY)
+				for ofst := int64(0); ofst < fileSize; ofst += readSize {
+					if n := fs.Read("/file", buff, ofst, fd); n != readSize {
+						b.Fatalf("Read(%d) = %d, want %d", ofst, n, readSize)
+					}
+				}
+				fs.Release("/file", fd)
+			}
+			b.ReportMetric(float64(atomic.LoadInt64(&bfs.reads))/float64(b.N), "backend-reads/op")
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package billycgofuse
+
+import (
+	"container/list"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// readCache keeps the contents of small files in memory for WithReadCache, evicting the least recently used files
+// when it's full.
+type readCache struct {
+	maxBytes    int64
+	maxFileSize int64
+
+	mtx  sync.Mutex
+	used int64
+	// gen is bumped on every invalidation, so files that were being loaded at the time aren't cached.
+	gen     uint64
+	lru     *list.List // of *readCacheEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+type readCacheEntry struct {
+	path string
+	data []byte
+}
+
+func newReadCache(maxBytes, maxFileSize int64) *readCache {
+	return &readCache{
+		maxBytes:    maxBytes,
+		maxFileSize: maxFileSize,
+		lru:         list.New(),
+		entries:     map[string]*list.Element{},
+	}
+}
+
+// get returns the cached contents of path.
+func (c *readCache) get(path string) ([]byte, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	e, ok := c.entries[path]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*readCacheEntry).data, true
+}
+
+// generation returns a value to pass to put for contents that are about to be loaded.
+func (c *readCache) generation() uint64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.gen
+}
+
+// put caches data as the contents of path, unless something was invalidated since gen was retrieved.
+func (c *readCache) put(path string, data []byte, gen uint64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.gen != gen || int64(len(data)) > c.maxBytes {
+		return
+	}
+	c.removeLocked(path)
+	c.entries[path] = c.lru.PushFront(&readCacheEntry{path, data})
+	c.used += int64(len(data))
+	for c.used > c.maxBytes {
+		c.removeLocked(c.lru.Back().Value.(*readCacheEntry).path)
+	}
+}
+
+// invalidate drops the contents of path and everything below it.
+func (c *readCache) invalidate(path string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.gen++
+	c.removeLocked(path)
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	for p := range c.entries {
+		if strings.HasPrefix(p, prefix) {
+			c.removeLocked(p)
+		}
+	}
+}
+
+func (c *readCache) removeLocked(path string) {
+	e, ok := c.entries[path]
+	if !ok {
+		return
+	}
+	c.lru.Remove(e)
+	delete(c.entries, path)
+	c.used -= int64(len(e.Value.(*readCacheEntry).data))
+}
+
+// readCached serves a read from the WithReadCache cache, loading the whole file if it's small enough.
+// It returns false if the file can't be cached.
+func (w *wrapper) readCached(path string, fh billy.File, buff []byte, ofst int64) (int, bool) {
+	data, ok := w.readCache.get(path)
+	if !ok {
+		gen := w.readCache.generation()
+		fi, err := w.statFile(path, fh)
+		if err != nil || !fi.Mode().IsRegular() || fi.Size() > w.readCache.maxFileSize {
+			return 0, false
+		}
+		// Read one byte more than expected, to notice files that grew since the stat.
+		data = make([]byte, fi.Size()+1)
+		n, err := w.readAtBackend(fh, data, 0)
+		if err != io.EOF || int64(n) > fi.Size() {
+			return 0, false
+		}
+		data = data[:n]
+		w.readCache.put(path, data, gen)
+	}
+	if ofst >= int64(len(data)) {
+		return 0, true
+	}
+	return copy(buff, data[ofst:]), true
+}
+
+// invalidateReadCache drops the cached contents of path and everything below it.
+func (w *wrapper) invalidateReadCache(path string) {
+	if w.readCache != nil {
+		w.readCache.invalidate(path)
+	}
+}
@@ -0,0 +1,96 @@
+package billycgofuse
+
+import (
+	"bytes"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReadCache(t *testing.T) {
+	bfs, data := newSlowFS(t, 0, 1000)
+	writeFile(t, bfs, "/big", string(make([]byte, 5000)))
+	fs := New(bfs, WithReadCache(1<<20, 4096))
+	readAll := func(path string, size int) []byte {
+		t.Helper()
+		fd := open(t, fs, path, os.O_RDONLY)
+		defer fs.Release(path, fd)
+		buff := make([]byte, size)
+		if n := fs.Read(path, buff, 0, fd); n != size {
+			t.Fatalf("Read(%q) = %d, want %d", path, n, size)
+		}
+		return buff
+	}
+	backendReads := func() int64 {
+		return atomic.LoadInt64(&bfs.reads)
+	}
+
+	readAll("/file", 1000)
+	before := backendReads()
+	for i := 0; i < 3; i++ {
+		if got := readAll("/file", 1000); !bytes.Equal(got, data) {
+			t.Fatalf("Read() returned the wrong data")
+		}
+	}
+	if n := backendReads() - before; n != 0 {
+		t.Errorf("cached file was read from the backend %d times, want 0", n)
+	}
+
+	// Files over the size limit aren't cached.
+	readAll("/big", 5000)
+	before = backendReads()
+	readAll("/big", 5000)
+	if backendReads() == before {
+		t.Errorf("file over the size limit was served from the cache")
+	}
+
+	// Writes drop the cached contents.
+	fd := open(t, fs, "/file", os.O_WRONLY)
+	if n := fs.Write("/file", []byte("changed"), 0, fd); n != 7 {
+		t.Fatalf("Write() = %d, want 7", n)
+	}
+	fs.Release("/file", fd)
+	if got := readAll("/file", 7); string(got) != "changed" {
+		t.Errorf("Read() after Write() = %q, want %q", got, "changed")
+	}
+
+	// So do truncations, even by path.
+	if errc := fs.Truncate("/file", 3, ^uint64(0)); errc != 0 {
+		t.Fatalf("Truncate() = %d", errc)
+	}
+	fd = open(t, fs, "/file", os.O_RDONLY)
+	defer fs.Release("/file", fd)
+	buff := make([]byte, 10)
+	if n := fs.Read("/file", buff, 0, fd); string(buff[:n]) != "cha" {
+		t.Errorf("Read() after Truncate() = %q, want %q", buff[:n], "cha")
+	}
+}
+
+func BenchmarkReadCache(b *testing.B) {
+	const fileSize = 4096
+	for _, bc := range []struct {
+		name string
+		opts []Option
+	}{
+		{"off", nil},
+		{"on", []Option{WithReadCache(1<<20, 64<<10)}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			bfs, _ := newSlowFS(b, 100*time.Microsecond, fileSize)
+			fs := New(bfs, bc.opts...)
+			buff := make([]byte, fileSize)
+			b.SetBytes(fileSize)
+			b.ResetTimer()
+			// Like a program that keeps rereading its configuration file.
+			for i := 0; i < b.N; i++ {
+				fd := open(b, fs, "/file", os.O_RDONLY)
+				if n := fs.Read("/file", buff, 0, fd); n != fileSize {
+					b.Fatalf("Read() = %d, want %d", n, fileSize)
+				}
+				fs.Release("/file", fd)
+			}
+			b.ReportMetric(float64(atomic.LoadInt64(&bfs.reads))/float64(b.N), "backend-reads/op")
+		})
+	}
+}
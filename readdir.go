@@ -0,0 +1,54 @@
+package billycgofuse
+
+import (
+	"os"
+
+	"github.com/billziss-gh/cgofuse/fuse"
+	"github.com/go-git/go-billy/v5"
+)
+
+// ReadDirPager can be implemented by a billy filesystem that can list a directory in pieces.
+// It's used when WithReaddirBatchSize is given, so huge directories don't have to be read in one go.
+type ReadDirPager interface {
+	// ReadDirPage returns at most n entries of the directory, skipping the first offset entries.
+	// The order must be stable between calls. Fewer than n entries means the end of the directory was reached.
+	ReadDirPage(path string, offset, n int) ([]os.FileInfo, error)
+}
+
+// readdirBatch passes at most readdirBatchSize entries starting at ofst to fill, with offsets so the kernel comes
+// back for the rest. Backends that implement ReadDirPager are asked for just that page. Others are read in full and
+// only the requested slice is kept, so entries created or removed between two calls might be skipped or repeated.
+func (w *wrapper) readdirBatch(dfs billy.Dir, path string,
+	fill func(name string, stat *fuse.Stat_t, ofst int64) bool,
+	ofst int64) int {
+	var entries []os.FileInfo
+	if p, ok := w.backend().(ReadDirPager); ok && w.flatSep == "" {
+		var err error
+		entries, err = p.ReadDirPage(path, int(ofst), w.readdirBatchSize)
+		if errc := w.readDirError(path, entries, err); errc != 0 {
+			return errc
+		}
+	} else {
+		var errc int
+		entries, errc = w.readDirSorted(dfs, path)
+		if errc != 0 {
+			return errc
+		}
+		if ofst >= int64(len(entries)) {
+			return 0
+		}
+		entries = entries[ofst:]
+		if len(entries) > w.readdirBatchSize {
+			entries = entries[:w.readdirBatchSize]
+		}
+	}
+	for i, e := range entries {
+		if w.hidden(path, e) {
+			continue
+		}
+		if !fill(e.Name(), w.direntStat(path, e), ofst+int64(i)+1) {
+			break
+		}
+	}
+	return 0
+}
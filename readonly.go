@@ -0,0 +1,30 @@
+package billycgofuse
+
+import (
+	gopath "path"
+)
+
+// isReadOnly returns whether any of paths, or a directory containing it, matches a pattern given to
+// WithReadOnlyPaths, or whether the WithReadOnlyAfter deadline has passed.
+func (w *wrapper) isReadOnly(paths ...string) bool {
+	if w.readOnlyAfter != nil && !w.now().Before(*w.readOnlyAfter) {
+		return true
+	}
+	if len(w.readOnlyPaths) == 0 {
+		return false
+	}
+	for _, p := range paths {
+		for {
+			for _, pattern := range w.readOnlyPaths {
+				if ok, _ := gopath.Match(pattern, p); ok {
+					return true
+				}
+			}
+			if p == "/" {
+				break
+			}
+			p = gopath.Dir(p)
+		}
+	}
+	return false
+}
@@ -0,0 +1,21 @@
+package billycgofuse
+
+import (
+	"sync/atomic"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// onReadReplica calls f with the next of the WithReadReplicas replicas. If there are none, or f fails on the
+// replica, f is called with the primary.
+func (w *wrapper) onReadReplica(f func(fs billy.Basic) error) error {
+	h := w.underlying.Load().(backendHolder)
+	if len(h.replicas) == 0 {
+		return f(h.fs)
+	}
+	i := atomic.AddUint64(&w.nextReplica, 1)
+	if err := f(h.replicas[i%uint64(len(h.replicas))]); err == nil {
+		return nil
+	}
+	return f(h.fs)
+}
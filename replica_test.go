@@ -0,0 +1,24 @@
+package billycgofuse
+
+import (
+	"testing"
+
+	"github.com/billziss-gh/cgofuse/fuse"
+	"github.com/go-git/go-billy/v5/memfs"
+)
+
+func TestReadReplicasWithStripPrefix(t *testing.T) {
+	primary, replica := memfs.New(), memfs.New()
+	writeFile(t, primary, "/data/file", "primary")
+	writeFile(t, replica, "/data/file", "replica!")
+	fs := New(primary, WithStripPrefix("data"), WithReadReplicas(replica))
+	for i := 0; i < 2; i++ {
+		var st fuse.Stat_t
+		if errc := fs.Getattr("/file", &st, ^uint64(0)); errc != 0 {
+			t.Fatalf("Getattr() = %d", errc)
+		}
+		if st.Size != int64(len("replica!")) {
+			t.Errorf("Getattr() reported size %d, want the file on the replica under the prefix", st.Size)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package billycgofuse
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// retry calls f until it succeeds, up to the number of attempts given to WithRetry, as long as the error is
+// considered transient. The wait between attempts starts at the backoff and doubles every time.
+// Without WithRetry, f is called once.
+func (w *wrapper) retry(f func() error) error {
+	err := f()
+	backoff := w.retryBackoff
+	for i := 1; i < w.retryAttempts && err != nil && err != io.EOF && w.isRetryable(err); i++ {
+		time.Sleep(backoff)
+		backoff *= 2
+		err = f()
+	}
+	return err
+}
+
+// retryNotExist calls f again while it fails because a file doesn't exist, up to the number of attempts given to
+// WithOpenRetryOnNotExist, waiting the delay given to it in between.
+func (w *wrapper) retryNotExist(f func() error) error {
+	err := f()
+	for i := 1; i < w.notExistAttempts && os.IsNotExist(err); i++ {
+		time.Sleep(w.notExistDelay)
+		err = f()
+	}
+	return err
+}
+
+// isTemporary is the default for WithRetry. It considers timeouts and errors that say they're temporary, like those
+// of the net package, transient.
+func isTemporary(err error) bool {
+	if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var t interface{ Temporary() bool }
+	return errors.As(err, &t) && t.Temporary()
+}
@@ -0,0 +1,143 @@
+package billycgofuse
+
+import (
+	gopath "path"
+	"sync"
+	"time"
+
+	"github.com/billziss-gh/cgofuse/fuse"
+	"github.com/go-git/go-billy/v5"
+)
+
+// StatFS holds file system statistics.
+type StatFS struct {
+	TotalBytes     uint64
+	FreeBytes      uint64
+	AvailableBytes uint64
+	TotalFiles     uint64
+	FreeFiles      uint64
+	// NameMax is the maximum length of a filename. Zero means 255.
+	NameMax uint64
+	// BlockSize is the preferred I/O size of the backend, which df uses to do its calculations.
+	// Zero means the block size of the StatFS given to WithStatfs, or 4096 if that doesn't have one either.
+	BlockSize uint64
+}
+
+// StatFSer can be implemented by a billy filesystem to report its usage to Statfs.
+// The path Statfs was called for is passed along, so backends with per-directory quotas can report those.
+type StatFSer interface {
+	StatFS(path string) (StatFS, error)
+}
+
+// defaultBlockSize is the block size reported by Statfs if nobody gave one.
+const defaultBlockSize = 4096
+
+// defaultStatFS is reported for backends that don't implement StatFSer.
+// It claims plenty of free space, so tools don't refuse to write.
+var defaultStatFS = StatFS{
+	TotalBytes:     1 << 50,
+	FreeBytes:      1 << 50,
+	AvailableBytes: 1 << 50,
+	TotalFiles:     1 << 32,
+	FreeFiles:      1 << 32,
+}
+
+// Statfs gets file system statistics.
+func (w *wrapper) Statfs(path string, stat *fuse.Statfs_t) int {
+	path, errc := cleanPath(path)
+	if errc != 0 {
+		return errc
+	}
+	st := w.defaultStatFS
+	if sfs, ok := w.backend().(StatFSer); ok {
+		var err error
+		st, err = sfs.StatFS(path)
+		if err != nil {
+			return convertError(err)
+		}
+	} else if w.fileCounter != nil {
+		w.countFiles(&st)
+	}
+	if st.BlockSize == 0 {
+		st.BlockSize = w.defaultStatFS.BlockSize
+	}
+	statFSToFuse(st, stat)
+	return 0
+}
+
+func statFSToFuse(st StatFS, out *fuse.Statfs_t) {
+	bsize := st.BlockSize
+	if bsize == 0 {
+		bsize = defaultBlockSize
+	}
+	nameMax := st.NameMax
+	if nameMax == 0 {
+		nameMax = 255
+	}
+	*out = fuse.Statfs_t{
+		Bsize:   bsize,
+		Frsize:  bsize,
+		Blocks:  st.TotalBytes / bsize,
+		Bfree:   st.FreeBytes / bsize,
+		Bavail:  st.AvailableBytes / bsize,
+		Files:   st.TotalFiles,
+		Ffree:   st.FreeFiles,
+		Favail:  st.FreeFiles,
+		Namemax: nameMax,
+	}
+}
+
+// fileCounter caches the number of files on the backend for WithStatfsFileCount.
+type fileCounter struct {
+	ttl time.Duration
+
+	mtx     sync.Mutex
+	count   uint64
+	counted time.Time
+	valid   bool
+}
+
+// countFiles reports the number of files and directories on the backend as used inodes in st.
+// Counting walks the whole backend, so the result is reused for the duration given to WithStatfsFileCount.
+func (w *wrapper) countFiles(st *StatFS) {
+	fc := w.fileCounter
+	fc.mtx.Lock()
+	defer fc.mtx.Unlock()
+	if !fc.valid || w.now().Sub(fc.counted) >= fc.ttl {
+		n, err := countTree(w.backend(), "/")
+		if err != nil {
+			w.logErrno("Statfs", "/", convertError(err))
+			return
+		}
+		fc.count = n
+		fc.counted = w.now()
+		fc.valid = true
+	}
+	if fc.count > st.TotalFiles {
+		st.TotalFiles = fc.count
+	}
+	st.FreeFiles = st.TotalFiles - fc.count
+}
+
+// countTree returns the number of entries below dir on fs.
+func countTree(fs billy.Basic, dir string) (uint64, error) {
+	if _, ok := fs.(billy.Dir); !ok {
+		return 0, billy.ErrNotSupported
+	}
+	entries, err := readDirFS(fs, dir)
+	if err != nil {
+		return 0, err
+	}
+	n := uint64(len(entries))
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		sub, err := countTree(fs, gopath.Join(dir, e.Name()))
+		if err != nil {
+			return 0, err
+		}
+		n += sub
+	}
+	return n, nil
+}
@@ -0,0 +1,18 @@
+package billycgofuse
+
+import "errors"
+
+// errTransformLength is returned if a WithContentTransform function changes the length of the data.
+var errTransformLength = errors.New("billycgofuse: content transform changed the length of the data")
+
+// transform applies a WithContentTransform function to data.
+func transform(f func([]byte) ([]byte, error), data []byte) ([]byte, error) {
+	out, err := f(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(out) != len(data) {
+		return nil, errTransformLength
+	}
+	return out, nil
+}
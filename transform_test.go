@@ -0,0 +1,57 @@
+package billycgofuse
+
+import (
+	"os"
+	"testing"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+)
+
+// invert flips all bits, which is its own inverse.
+func invert(data []byte) ([]byte, error) {
+	out := make([]byte, len(data))
+	for i, b := range data {
+		out[i] = ^b
+	}
+	return out, nil
+}
+
+func TestContentTransformTruncateGrow(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		noGrow bool
+	}{
+		{"backend grows files", false},
+		{"backend doesn't grow files", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			bfs := memfs.New()
+			var backend billy.Filesystem = bfs
+			if tc.noGrow {
+				backend = noGrowFS{bfs}
+			}
+			fs := New(backend, WithContentTransform(invert, invert))
+			errc, fd := fs.Create("/file", os.O_RDWR, 0644)
+			if errc != 0 {
+				t.Fatalf("Create() = %d", errc)
+			}
+			defer fs.Release("/file", fd)
+			if n := fs.Write("/file", []byte("abc"), 0, fd); n != 3 {
+				t.Fatalf("Write() = %d, want 3", n)
+			}
+			if errc := fs.Truncate("/file", 6, fd); errc != 0 {
+				t.Fatalf("Truncate() = %d", errc)
+			}
+			buff := make([]byte, 10)
+			if n := fs.Read("/file", buff, 0, fd); string(buff[:n]) != "abc\x00\x00\x00" {
+				t.Errorf("Read() = %q, want %q", buff[:n], "abc\x00\x00\x00")
+			}
+			data, err := util.ReadFile(bfs, "/file")
+			if want := "\x9e\x9d\x9c\xff\xff\xff"; err != nil || string(data) != want {
+				t.Errorf("ReadFile() = %q, %v; want %q", data, err, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package billycgofuse
+
+import (
+	"bytes"
+	"os"
+	gopath "path"
+	"time"
+
+	"github.com/billziss-gh/cgofuse/fuse"
+	"github.com/go-git/go-billy/v5"
+)
+
+// virtualContents returns the contents of the WithVirtualFile file at path, if there is one.
+func (w *wrapper) virtualContents(path string) (func() ([]byte, error), bool) {
+	f, ok := w.virtualFiles[path]
+	return f, ok
+}
+
+// isVirtual returns whether any of the paths is a WithVirtualFile file.
+func (w *wrapper) isVirtual(paths ...string) bool {
+	for _, p := range paths {
+		if _, ok := w.virtualContents(p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// statVirtual returns the attributes of a virtual file.
+func (w *wrapper) statVirtual(path string, contents func() ([]byte, error)) (os.FileInfo, error) {
+	data, err := contents()
+	if err != nil {
+		return nil, err
+	}
+	return virtualFileInfo{name: gopath.Base(path), size: int64(len(data)), modTime: w.now()}, nil
+}
+
+// openVirtual opens a virtual file. Its contents are generated once and don't change while it's open.
+func (w *wrapper) openVirtual(path string, flags int, contents func() ([]byte, error)) (int, uint64) {
+	if flags&(os.O_WRONLY|os.O_RDWR|os.O_TRUNC|os.O_APPEND) != 0 {
+		return -fuse.EROFS, 0
+	}
+	data, err := contents()
+	if err != nil {
+		return convertError(err), 0
+	}
+	return 0, w.createFileDescriptor(path, flags, &virtualFile{Reader: bytes.NewReader(data), name: path})
+}
+
+// addVirtualEntries adds the virtual files in dir to a directory listing, replacing entries with the same name.
+func (w *wrapper) addVirtualEntries(dir string, entries []os.FileInfo) []os.FileInfo {
+	var virtual []os.FileInfo
+	names := map[string]bool{}
+	for p, contents := range w.virtualFiles {
+		if gopath.Dir(p) != dir {
+			continue
+		}
+		fi, err := w.statVirtual(p, contents)
+		if err != nil {
+			w.logf("virtual file %q: %v", p, err)
+			continue
+		}
+		virtual = append(virtual, fi)
+		names[fi.Name()] = true
+	}
+	if len(virtual) == 0 {
+		return entries
+	}
+	ret := virtual
+	for _, e := range entries {
+		if !names[e.Name()] {
+			ret = append(ret, e)
+		}
+	}
+	return ret
+}
+
+// virtualFile is a read-only billy.File over generated contents.
+type virtualFile struct {
+	*bytes.Reader
+	name string
+}
+
+func (f *virtualFile) Name() string {
+	return f.name
+}
+
+func (f *virtualFile) Write(p []byte) (int, error) {
+	return 0, billy.ErrReadOnly
+}
+
+func (f *virtualFile) Truncate(size int64) error {
+	return billy.ErrReadOnly
+}
+
+func (f *virtualFile) Close() error {
+	return nil
+}
+
+func (f *virtualFile) Lock() error {
+	return nil
+}
+
+func (f *virtualFile) Unlock() error {
+	return nil
+}
+
+// virtualFileInfo describes a virtual file.
+type virtualFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (fi virtualFileInfo) Name() string       { return fi.name }
+func (fi virtualFileInfo) Size() int64        { return fi.size }
+func (fi virtualFileInfo) Mode() os.FileMode  { return 0444 }
+func (fi virtualFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi virtualFileInfo) IsDir() bool        { return false }
+func (fi virtualFileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,36 @@
+package billycgofuse
+
+import (
+	"testing"
+
+	"github.com/billziss-gh/cgofuse/fuse"
+)
+
+func TestVirtualFileIsReadOnly(t *testing.T) {
+	fs, bfs := newTestFS(t, WithVirtualFile("/status", func() ([]byte, error) {
+		return []byte("ok"), nil
+	}))
+	writeFile(t, bfs, "/file", "hello")
+	for _, tc := range []struct {
+		name string
+		op   func() int
+	}{
+		{"Rename from", func() int { return fs.Rename("/status", "/other") }},
+		{"Rename to", func() int { return fs.Rename("/file", "/status") }},
+		{"Chmod", func() int { return fs.Chmod("/status", 0600) }},
+		{"Chown", func() int { return fs.Chown("/status", 1, 1) }},
+		{"Utimens", func() int { return fs.Utimens("/status", nil) }},
+		{"Mkdir", func() int { return fs.Mkdir("/status", 0755) }},
+		{"Symlink", func() int { return fs.Symlink("/file", "/status") }},
+		{"Mknod", func() int { return fs.Mknod("/status", fuse.S_IFREG|0644, 0) }},
+		{"Unlink", func() int { return fs.Unlink("/status") }},
+		{"Truncate", func() int { return fs.Truncate("/status", 0, ^uint64(0)) }},
+	} {
+		if errc := tc.op(); errc != -fuse.EROFS {
+			t.Errorf("%s = %d, want %d", tc.name, errc, -fuse.EROFS)
+		}
+	}
+	if _, err := bfs.Stat("/status"); err == nil {
+		t.Errorf("a file was created on the backend under the virtual file")
+	}
+}
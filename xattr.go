@@ -0,0 +1,183 @@
+package billycgofuse
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	gopath "path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/billziss-gh/cgofuse/fuse"
+)
+
+// sidecarXattrs stores extended attributes in a file next to the file they belong to, for WithSidecarXattrs.
+// The attributes of "/dir/foo" are stored as JSON in "/dir/.foo<suffix>".
+type sidecarXattrs struct {
+	suffix string
+	// mtx serializes modifications, which read and rewrite the whole sidecar.
+	mtx sync.Mutex
+}
+
+// sidecarPath returns the path of the sidecar file for path.
+func (s *sidecarXattrs) sidecarPath(path string) string {
+	return gopath.Join(gopath.Dir(path), "."+gopath.Base(path)+s.suffix)
+}
+
+// isSidecar returns whether the entry name in dir is the sidecar file of another file. Files that merely look like
+// one, like ".eslintrc.json" with suffix ".json", are not: the file they would belong to doesn't exist.
+func (w *wrapper) isSidecar(dir, name string) bool {
+	s := w.sidecars
+	if s == nil || !strings.HasPrefix(name, ".") || !strings.HasSuffix(name, s.suffix) || len(name) <= 1+len(s.suffix) {
+		return false
+	}
+	primary := gopath.Join(dir, strings.TrimSuffix(name[1:], s.suffix))
+	_, err := w.lstat(w.flatToBackend(primary))
+	return err == nil
+}
+
+// readXattrs returns the extended attributes of path. A missing sidecar means there are none.
+func (w *wrapper) readXattrs(path string) (map[string][]byte, error) {
+	fh, err := w.backend().Open(w.flatToBackend(w.sidecars.sidecarPath(path)))
+	if os.IsNotExist(err) {
+		return map[string][]byte{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	data, err := io.ReadAll(fh)
+	if err != nil {
+		return nil, err
+	}
+	attrs := map[string][]byte{}
+	if err := json.Unmarshal(data, &attrs); err != nil {
+		return nil, err
+	}
+	return attrs, nil
+}
+
+// writeXattrs replaces the extended attributes of path. The sidecar is removed if there are none left.
+func (w *wrapper) writeXattrs(path string, attrs map[string][]byte) error {
+	sidecar := w.flatToBackend(w.sidecars.sidecarPath(path))
+	if len(attrs) == 0 {
+		if err := w.backend().Remove(sidecar); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.Marshal(attrs)
+	if err != nil {
+		return err
+	}
+	fh, err := w.backend().OpenFile(sidecar, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := fh.Write(data); err != nil {
+		fh.Close()
+		return err
+	}
+	return fh.Close()
+}
+
+// setxattr implements Setxattr with WithSidecarXattrs.
+func (w *wrapper) setxattr(path, name string, value []byte, flags int) int {
+	if w.isReadOnly(path) {
+		return -fuse.EROFS
+	}
+	if _, err := w.lstat(w.flatToBackend(path)); err != nil {
+		return convertError(err)
+	}
+	w.sidecars.mtx.Lock()
+	defer w.sidecars.mtx.Unlock()
+	attrs, err := w.readXattrs(path)
+	if err != nil {
+		return convertError(err)
+	}
+	_, exists := attrs[name]
+	switch {
+	case flags&fuse.XATTR_CREATE != 0 && exists:
+		return -fuse.EEXIST
+	case flags&fuse.XATTR_REPLACE != 0 && !exists:
+		return -fuse.ENOATTR
+	}
+	attrs[name] = append([]byte(nil), value...)
+	return convertError(w.writeXattrs(path, attrs))
+}
+
+// getxattr implements Getxattr with WithSidecarXattrs.
+func (w *wrapper) getxattr(path, name string) (int, []byte) {
+	attrs, err := w.readXattrs(path)
+	if err != nil {
+		return convertError(err), nil
+	}
+	value, ok := attrs[name]
+	if !ok {
+		return -fuse.ENOATTR, nil
+	}
+	return 0, value
+}
+
+// removexattr implements Removexattr with WithSidecarXattrs.
+func (w *wrapper) removexattr(path, name string) int {
+	if w.isReadOnly(path) {
+		return -fuse.EROFS
+	}
+	w.sidecars.mtx.Lock()
+	defer w.sidecars.mtx.Unlock()
+	attrs, err := w.readXattrs(path)
+	if err != nil {
+		return convertError(err)
+	}
+	if _, ok := attrs[name]; !ok {
+		return -fuse.ENOATTR
+	}
+	delete(attrs, name)
+	return convertError(w.writeXattrs(path, attrs))
+}
+
+// listxattr implements Listxattr with WithSidecarXattrs.
+func (w *wrapper) listxattr(path string, fill func(name string) bool) int {
+	attrs, err := w.readXattrs(path)
+	if err != nil {
+		return convertError(err)
+	}
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !fill(name) {
+			return -fuse.ERANGE
+		}
+	}
+	return 0
+}
+
+// removeSidecar removes the extended attributes of path after it was removed.
+func (w *wrapper) removeSidecar(path string) {
+	if w.sidecars == nil {
+		return
+	}
+	sidecar := w.flatToBackend(w.sidecars.sidecarPath(path))
+	if err := w.backend().Remove(sidecar); err != nil && !os.IsNotExist(err) {
+		w.logErrno("Remove", sidecar, convertError(err))
+	}
+}
+
+// renameSidecar moves the extended attributes of oldpath along after it was renamed to newpath.
+func (w *wrapper) renameSidecar(oldpath, newpath string) {
+	if w.sidecars == nil {
+		return
+	}
+	// The attributes of a file that was replaced by the rename go away with it.
+	w.removeSidecar(newpath)
+	oldSidecar := w.flatToBackend(w.sidecars.sidecarPath(oldpath))
+	newSidecar := w.flatToBackend(w.sidecars.sidecarPath(newpath))
+	if err := w.backend().Rename(oldSidecar, newSidecar); err != nil && !os.IsNotExist(err) {
+		w.logErrno("Rename", oldSidecar, convertError(err))
+	}
+}
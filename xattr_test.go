@@ -0,0 +1,42 @@
+package billycgofuse
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/billziss-gh/cgofuse/fuse"
+)
+
+func TestSidecarXattrs(t *testing.T) {
+	fs, bfs := newTestFS(t, WithSidecarXattrs(".json"))
+	writeFile(t, bfs, "/file", "hello")
+	// This looks like a sidecar, but there's no "eslintrc" it would belong to.
+	writeFile(t, bfs, "/.eslintrc.json", "{}")
+	if errc := fs.Setxattr("/file", "user.color", []byte("blue"), 0); errc != 0 {
+		t.Fatalf("Setxattr() = %d", errc)
+	}
+	if errc, value := fs.Getxattr("/file", "user.color"); errc != 0 || string(value) != "blue" {
+		t.Errorf("Getxattr() = %d, %q; want %q", errc, value, "blue")
+	}
+
+	var names []string
+	fill := func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		names = append(names, name)
+		return true
+	}
+	if errc := fs.Readdir("/", fill, 0, ^uint64(0)); errc != 0 {
+		t.Fatalf("Readdir() = %d", errc)
+	}
+	sort.Strings(names)
+	if want := []string{".eslintrc.json", "file"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Readdir() = %q, want %q", names, want)
+	}
+
+	// Getxattr doesn't look these up, so they can't be stored either.
+	for _, name := range []string{"security.selinux", "system.posix_acl_access"} {
+		if errc := fs.Setxattr("/file", name, []byte("x"), 0); errc != -fuse.ENOTSUP {
+			t.Errorf("Setxattr(%q) = %d, want %d", name, errc, -fuse.ENOTSUP)
+		}
+	}
+}